@@ -16,3 +16,10 @@ func atime(fi os.FileInfo) time.Time {
     stat := fi.Sys().(*syscall.Stat_t)
     return time.Unix(stat.Atim.Unix())
 }
+
+// Bytes actually allocated for the file, sparse files take less than
+// their size.
+func diskUsage(fi os.FileInfo) int64 {
+    stat := fi.Sys().(*syscall.Stat_t)
+    return int64(stat.Blocks) * 512
+}
@@ -0,0 +1,397 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    log "github.com/Sirupsen/logrus"
+    "golang.org/x/net/context"
+    "golang.org/x/oauth2"
+    "golang.org/x/oauth2/jwt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "strings"
+    "time"
+)
+
+const (
+    // How long the browser is waited for.
+    authTimeout = 5 * time.Minute
+    // Redirect of the headless authorization, nothing listens there so
+    // the browser stays on the address with the code.
+    pasteRedirectURL = "http://127.0.0.1/"
+    // Where the device flow starts.
+    GoogleDeviceAuthURL = "https://oauth2.googleapis.com/device/code"
+    // Lifetime of the device code unless the server sets one.
+    deviceExpiry    = 30 * time.Minute
+    grantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// Polling interval of the device flow unless the server sets one, it
+// grows by the same step whenever the server asks to slow down.
+var deviceInterval = 5 * time.Second
+
+var (
+    ErrAuthState   = errors.New("Authorization state does not match")
+    ErrAuthNoCode  = errors.New("No authorization code in the redirect")
+    ErrAuthTimeout = errors.New("Timed out waiting for the authorization")
+    ErrAuthNoToken = errors.New("No refresh token received")
+    ErrBadKey      = errors.New("Not a service account key")
+)
+
+// Authorization code request protected by PKCE, only the hash of the
+// verifier is sent with the request so the code is worthless to
+// anybody else who gets it. The state ties the redirect to the
+// request.
+type authRequest struct {
+    config   oauth2.Config
+    verifier string
+    state    string
+}
+
+// Device code the user enters at the verification address, google
+// names the address verification_url instead of verification_uri.
+type deviceCode struct {
+    DeviceCode      string `json:"device_code"`
+    UserCode        string `json:"user_code"`
+    VerificationURI string `json:"verification_uri"`
+    VerificationURL string `json:"verification_url"`
+    ExpiresIn       int    `json:"expires_in"`
+    Interval        int    `json:"interval"`
+}
+
+// Response of the token endpoint, either the token or the error.
+type deviceToken struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int    `json:"expires_in"`
+    Error        string `json:"error"`
+    Description  string `json:"error_description"`
+}
+
+// The fields of the JSON key of a service account grivefs needs.
+type serviceAccountKey struct {
+    Type         string `json:"type"`
+    PrivateKeyId string `json:"private_key_id"`
+    PrivateKey   string `json:"private_key"`
+    ClientEmail  string `json:"client_email"`
+    TokenURI     string `json:"token_uri"`
+}
+
+// Token source of the service account set in the configuration, the
+// tokens are issued for the subject when it is set, which needs the
+// domain-wide delegation. A read-only mount asks for read-only access.
+func serviceAccountSource(c *Config) (oauth2.TokenSource, error) {
+    p := c.ServiceAccount
+    if !path.IsAbs(p) {
+        p = path.Join(c.DataDir, p)
+    }
+    data, err := ioutil.ReadFile(p)
+    if err != nil {
+        return nil, err
+    }
+    key, err := parseServiceAccountKey(data)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", p, err)
+    }
+    scope := Scope
+    if c.ReadOnly {
+        scope = ReadOnlyScope
+    }
+    jc := &jwt.Config{
+        Email:        key.ClientEmail,
+        PrivateKey:   []byte(key.PrivateKey),
+        PrivateKeyID: key.PrivateKeyId,
+        Subject:      c.Subject,
+        Scopes:       []string{scope},
+        TokenURL:     key.TokenURI,
+    }
+    if jc.TokenURL == "" {
+        jc.TokenURL = GoogleOAuth2TokenURL
+    }
+    return jc.TokenSource(oauth2.NoContext), nil
+}
+
+// Reads the JSON key and checks the private key so a broken key fails
+// right away and not on the first request.
+func parseServiceAccountKey(data []byte) (*serviceAccountKey, error) {
+    var key serviceAccountKey
+    if err := json.Unmarshal(data, &key); err != nil {
+        return nil, err
+    }
+    if key.Type != "service_account" || key.ClientEmail == "" {
+        return nil, ErrBadKey
+    }
+    block, _ := pem.Decode([]byte(key.PrivateKey))
+    if block == nil {
+        return nil, errors.New("No PEM encoded private key")
+    }
+    if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+        if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+            return nil, err
+        }
+    }
+    return &key, nil
+}
+
+// Authorizes grivefs to access the drive and stores the refresh token
+// in the configuration. With device set the user enters a code on any
+// other device, otherwise the browser is used.
+func authorizeConfig(c *Config, device bool) (*oauth2.Token, error) {
+    config := makeOAuthConfig(c)
+    var tok *oauth2.Token
+    var err error
+    if device {
+        tok, err = authorizeDevice(config, GoogleDeviceAuthURL, os.Stdout)
+    } else {
+        tok, err = authorize(config, c.Headless, os.Stdin, os.Stdout)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if tok.RefreshToken == "" {
+        return nil, ErrAuthNoToken
+    }
+    c.RefreshToken = tok.RefreshToken
+    return tok, c.Write()
+}
+
+// Asks the user to authorize the access to the drive and returns the
+// token. The browser is redirected to a listener on the loopback
+// interface unless headless is set or there is nothing to listen on,
+// then the user pastes the address the browser was redirected to.
+func authorize(config *oauth2.Config, headless bool, in io.Reader, out io.Writer) (*oauth2.Token, error) {
+    if !headless {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err == nil {
+            return authorizeLoopback(config, l, out)
+        }
+        log.WithField("func", "auth.go:authorize").
+            Warnf("Can't listen for the redirect, %v", err)
+    }
+    return authorizePaste(config, in, out)
+}
+
+// Gets the code from the redirect to the listener, which is closed
+// when done.
+func authorizeLoopback(config *oauth2.Config, l net.Listener, out io.Writer) (*oauth2.Token, error) {
+    logger := log.WithField("func", "auth.go:authorizeLoopback")
+    a, err := makeAuthRequest(config, fmt.Sprintf("http://%s/", l.Addr()))
+    if err != nil {
+        l.Close()
+        return nil, err
+    }
+
+    type result struct {
+        tok *oauth2.Token
+        err error
+    }
+    done := make(chan result, 1)
+    srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+        if r.URL.Path != "/" {
+            http.NotFound(w, r)
+            return
+        }
+        if q.Get("state") != a.state {
+            // Not our redirect, keep waiting for it.
+            logger.Warn(ErrAuthState)
+            http.Error(w, ErrAuthState.Error(), http.StatusBadRequest)
+            return
+        }
+        tok, err := a.exchange(q)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+        } else {
+            fmt.Fprintln(w, "grivefs is authorized, you can close this window.")
+        }
+        select {
+        case done <- result{tok, err}:
+        default:
+        }
+    })}
+    go srv.Serve(l)
+    defer srv.Shutdown(context.Background())
+
+    fmt.Fprintln(out, "Please visit this URL to authorize grivefs")
+    fmt.Fprintln(out, a.URL())
+    select {
+    case r := <-done:
+        return r.tok, r.err
+    case <-time.After(authTimeout):
+        return nil, ErrAuthTimeout
+    }
+}
+
+// Gets the code from the address the browser was redirected to, the
+// user pastes it from the browser on any machine.
+func authorizePaste(config *oauth2.Config, in io.Reader, out io.Writer) (*oauth2.Token, error) {
+    a, err := makeAuthRequest(config, pasteRedirectURL)
+    if err != nil {
+        return nil, err
+    }
+    fmt.Fprintln(out, "Please visit this URL to authorize grivefs")
+    fmt.Fprintln(out, a.URL())
+    fmt.Fprintln(out, "The browser then fails to load a page at "+pasteRedirectURL)
+    fmt.Fprint(out, "Paste the address of that page: ")
+    line, err := bufio.NewReader(in).ReadString('\n')
+    if err != nil && line == "" {
+        return nil, err
+    }
+    u, err := url.Parse(strings.TrimSpace(line))
+    if err != nil {
+        return nil, err
+    }
+    return a.exchange(u.Query())
+}
+
+// Gets the token by the device authorization grant, the user enters
+// the printed code at the printed address while the token endpoint is
+// polled until the access is granted, refused or the code expires.
+// Google grants only the files scope to devices, the mount then shows
+// just the files grivefs created.
+func authorizeDevice(config *oauth2.Config, deviceURL string, out io.Writer) (*oauth2.Token, error) {
+    logger := log.WithField("func", "auth.go:authorizeDevice")
+    resp, err := http.PostForm(deviceURL, url.Values{
+        "client_id": {config.ClientID},
+        "scope":     {FileScope},
+    })
+    if err != nil {
+        return nil, err
+    }
+    var dc deviceCode
+    err = decodeAuthResponse(resp, &dc)
+    if err != nil {
+        return nil, err
+    }
+    if dc.VerificationURI == "" {
+        dc.VerificationURI = dc.VerificationURL
+    }
+    fmt.Fprintf(out, "Please visit %s and enter the code %s\n",
+        dc.VerificationURI, dc.UserCode)
+    fmt.Fprintln(out, "Only the files created by grivefs will be visible")
+
+    interval := deviceInterval
+    if dc.Interval > 0 {
+        interval = time.Duration(dc.Interval) * time.Second
+    }
+    expiry := deviceExpiry
+    if dc.ExpiresIn > 0 {
+        expiry = time.Duration(dc.ExpiresIn) * time.Second
+    }
+    deadline := time.Now().Add(expiry)
+    for time.Now().Before(deadline) {
+        time.Sleep(interval)
+        resp, err := http.PostForm(config.Endpoint.TokenURL, url.Values{
+            "client_id":     {config.ClientID},
+            "client_secret": {config.ClientSecret},
+            "device_code":   {dc.DeviceCode},
+            "grant_type":    {grantDeviceCode},
+        })
+        if err != nil {
+            return nil, err
+        }
+        var t deviceToken
+        if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+            resp.Body.Close()
+            return nil, err
+        }
+        resp.Body.Close()
+        switch t.Error {
+        case "":
+            tok := &oauth2.Token{
+                AccessToken:  t.AccessToken,
+                RefreshToken: t.RefreshToken,
+                TokenType:    t.TokenType,
+            }
+            if t.ExpiresIn > 0 {
+                tok.Expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+            }
+            return tok, nil
+        case "authorization_pending":
+        case "slow_down":
+            interval += deviceInterval
+            logger.Debugf("Polling every %v", interval)
+        default:
+            return nil, fmt.Errorf("Authorization refused: %s %s", t.Error, t.Description)
+        }
+    }
+    return nil, ErrAuthTimeout
+}
+
+// Decodes the JSON response, an error status is returned as error.
+func decodeAuthResponse(resp *http.Response, v interface{}) error {
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        var t deviceToken
+        json.NewDecoder(resp.Body).Decode(&t)
+        return fmt.Errorf("Authorization failed: %s %s %s", resp.Status, t.Error, t.Description)
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//
+func makeAuthRequest(config *oauth2.Config, redirectURL string) (*authRequest, error) {
+    verifier, err := randomString(32)
+    if err != nil {
+        return nil, err
+    }
+    state, err := randomString(16)
+    if err != nil {
+        return nil, err
+    }
+    a := &authRequest{config: *config, verifier: verifier, state: state}
+    a.config.RedirectURL = redirectURL
+    return a, nil
+}
+
+// The address the user authorizes the access at.
+func (a *authRequest) URL() string {
+    sum := sha256.Sum256([]byte(a.verifier))
+    return a.config.AuthCodeURL(a.state, oauth2.AccessTypeOffline,
+        oauth2.SetAuthURLParam("code_challenge",
+            base64.RawURLEncoding.EncodeToString(sum[:])),
+        oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+}
+
+// Exchanges the code from the query of the redirect for the token,
+// the redirect must carry the state of the request.
+func (a *authRequest) exchange(q url.Values) (*oauth2.Token, error) {
+    if q.Get("state") != a.state {
+        return nil, ErrAuthState
+    }
+    if e := q.Get("error"); e != "" {
+        return nil, fmt.Errorf("Authorization refused: %s", e)
+    }
+    code := q.Get("code")
+    if code == "" {
+        return nil, ErrAuthNoCode
+    }
+    return a.config.Exchange(oauth2.NoContext, code,
+        oauth2.SetAuthURLParam("code_verifier", a.verifier))
+}
+
+// Random string of n bytes encoded to be used in an URL.
+func randomString(n int) (string, error) {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
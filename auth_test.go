@@ -0,0 +1,564 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "golang.org/x/oauth2"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const (
+    fakeAuthCode     = "code"
+    fakeRefreshToken = "refresh"
+    fakeDeviceCode   = "device"
+    fakeAccountEmail = "grivefs@example.iam.gserviceaccount.com"
+    grantJWTBearer   = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// Authorization server which grants the code to anybody right away
+// and checks the PKCE verifier when the code is exchanged. The device
+// flow is answered with the polls one by one, an empty one grants the
+// token, the last one is repeated.
+type fakeAuthServer struct {
+    *httptest.Server
+    sync.Mutex
+    challenge string
+    exchanges int
+    claims    map[string]interface{}
+    expiresIn int
+    polls     []string
+    polled    []time.Time
+}
+
+//
+func makeFakeAuthServer() *fakeAuthServer {
+    s := &fakeAuthServer{}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/auth", s.auth)
+    mux.HandleFunc("/device", s.device)
+    mux.HandleFunc("/token", s.token)
+    s.Server = httptest.NewServer(mux)
+    return s
+}
+
+// Redirects the browser back with the code, the challenge is kept for
+// the exchange.
+func (s *fakeAuthServer) auth(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    if q.Get("code_challenge_method") != "S256" || q.Get("access_type") != "offline" {
+        http.Error(w, "Bad authorization request", http.StatusBadRequest)
+        return
+    }
+    u, err := url.Parse(q.Get("redirect_uri"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    s.Lock()
+    s.challenge = q.Get("code_challenge")
+    s.Unlock()
+    u.RawQuery = url.Values{"code": {fakeAuthCode}, "state": {q.Get("state")}}.Encode()
+    http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Hands out the device code for the files scope.
+func (s *fakeAuthServer) device(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    if r.Form.Get("client_id") != "client" || r.Form.Get("scope") != FileScope {
+        http.Error(w, "Bad device request", http.StatusBadRequest)
+        return
+    }
+    s.Lock()
+    defer s.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(deviceCode{
+        DeviceCode:      fakeDeviceCode,
+        UserCode:        "USER-CODE",
+        VerificationURL: s.URL + "/verify",
+        ExpiresIn:       s.expiresIn,
+    })
+}
+
+// Answers the poll of the device flow.
+func (s *fakeAuthServer) poll(w http.ResponseWriter, r *http.Request) {
+    s.Lock()
+    defer s.Unlock()
+    s.polled = append(s.polled, time.Now())
+    answer := "invalid_grant"
+    if r.Form.Get("device_code") == fakeDeviceCode && len(s.polls) > 0 {
+        answer = s.polls[0]
+        if len(s.polls) > 1 {
+            s.polls = s.polls[1:]
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if answer != "" {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(deviceToken{Error: answer})
+        return
+    }
+    json.NewEncoder(w).Encode(deviceToken{
+        AccessToken:  "access",
+        RefreshToken: fakeRefreshToken,
+        TokenType:    "Bearer",
+        ExpiresIn:    3600,
+    })
+}
+
+// Issues the token to a service account, the claims of the assertion
+// are kept, its signature is not checked.
+func (s *fakeAuthServer) assert(w http.ResponseWriter, r *http.Request) {
+    parts := strings.Split(r.Form.Get("assertion"), ".")
+    if len(parts) != 3 {
+        http.Error(w, "Bad assertion", http.StatusBadRequest)
+        return
+    }
+    data, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    var claims map[string]interface{}
+    if err := json.Unmarshal(data, &claims); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    s.Lock()
+    s.claims = claims
+    s.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(deviceToken{
+        AccessToken: "access",
+        TokenType:   "Bearer",
+        ExpiresIn:   3600,
+    })
+}
+
+// Issues the token when the verifier hashes to the challenge.
+func (s *fakeAuthServer) token(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    switch r.Form.Get("grant_type") {
+    case grantDeviceCode:
+        s.poll(w, r)
+        return
+    case grantJWTBearer:
+        s.assert(w, r)
+        return
+    }
+    sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+    s.Lock()
+    valid := r.Form.Get("code") == fakeAuthCode &&
+        base64.RawURLEncoding.EncodeToString(sum[:]) == s.challenge
+    if valid {
+        s.exchanges++
+    }
+    s.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    if !valid {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, `{"error":"invalid_grant"}`)
+        return
+    }
+    json.NewEncoder(w).Encode(deviceToken{
+        AccessToken:  "access",
+        RefreshToken: fakeRefreshToken,
+        TokenType:    "Bearer",
+        ExpiresIn:    3600,
+    })
+}
+
+//
+func (s *fakeAuthServer) config() *oauth2.Config {
+    return &oauth2.Config{
+        ClientID:     "client",
+        ClientSecret: "secret",
+        Scopes:       []string{Scope},
+        Endpoint: oauth2.Endpoint{
+            AuthURL:  s.URL + "/auth",
+            TokenURL: s.URL + "/token",
+        },
+    }
+}
+
+// The address the browser is redirected to from the authorization.
+func (s *fakeAuthServer) redirect(authURL string) (string, error) {
+    c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+    }}
+    resp, err := c.Get(authURL)
+    if err != nil {
+        return "", err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusFound {
+        return "", fmt.Errorf("Authorization got %s", resp.Status)
+    }
+    return resp.Header.Get("Location"), nil
+}
+
+// Times the device flow polled the token endpoint at.
+func (s *fakeAuthServer) pollTimes() []time.Time {
+    s.Lock()
+    defer s.Unlock()
+    return append([]time.Time(nil), s.polled...)
+}
+
+// Claims of the last service account assertion.
+func (s *fakeAuthServer) claimed() map[string]interface{} {
+    s.Lock()
+    defer s.Unlock()
+    return s.claims
+}
+
+//
+func (s *fakeAuthServer) exchanged() int {
+    s.Lock()
+    defer s.Unlock()
+    return s.exchanges
+}
+
+// Finds the authorization address in the printed instructions, the
+// rest of the output is thrown away.
+func readAuthURL(out io.Reader, s *fakeAuthServer) (string, error) {
+    sc := bufio.NewScanner(out)
+    for sc.Scan() {
+        if strings.HasPrefix(sc.Text(), s.URL) {
+            go io.Copy(ioutil.Discard, out)
+            return sc.Text(), nil
+        }
+    }
+    return "", fmt.Errorf("No authorization URL printed")
+}
+
+func TestAuthorizeLoopback(t *testing.T) {
+    s := makeFakeAuthServer()
+    defer s.Close()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    or, ow := io.Pipe()
+    defer ow.Close()
+
+    browser := make(chan error, 1)
+    go func() {
+        authURL, err := readAuthURL(or, s)
+        if err != nil {
+            browser <- err
+            return
+        }
+        // A redirect with another state is refused and the right one
+        // is still waited for.
+        resp, err := http.Get(fmt.Sprintf("http://%s/?code=%s&state=forged", l.Addr(), fakeAuthCode))
+        if err != nil {
+            browser <- err
+            return
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusBadRequest {
+            browser <- fmt.Errorf("Forged redirect got %s", resp.Status)
+            return
+        }
+        resp, err = http.Get(authURL)
+        if err != nil {
+            browser <- err
+            return
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            err = fmt.Errorf("Redirect got %s", resp.Status)
+        }
+        browser <- err
+    }()
+
+    tok, err := authorizeLoopback(s.config(), l, ow)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := <-browser; err != nil {
+        t.Fatal(err)
+    }
+    if tok.RefreshToken != fakeRefreshToken {
+        t.Errorf("Got refresh token %q, expected %q", tok.RefreshToken, fakeRefreshToken)
+    }
+    if n := s.exchanged(); n != 1 {
+        t.Errorf("Exchanged the code %d times, expected once", n)
+    }
+}
+
+func TestAuthorizePaste(t *testing.T) {
+    s := makeFakeAuthServer()
+    defer s.Close()
+    ir, iw := io.Pipe()
+    or, ow := io.Pipe()
+    defer ow.Close()
+
+    go func() {
+        authURL, err := readAuthURL(or, s)
+        if err != nil {
+            iw.CloseWithError(err)
+            return
+        }
+        loc, err := s.redirect(authURL)
+        if err != nil {
+            iw.CloseWithError(err)
+            return
+        }
+        if !strings.HasPrefix(loc, pasteRedirectURL) {
+            iw.CloseWithError(fmt.Errorf("Redirected to %s", loc))
+            return
+        }
+        // Pasted with the spaces and the line end of a terminal.
+        fmt.Fprintf(iw, "  %s \r\n", loc)
+    }()
+
+    tok, err := authorizePaste(s.config(), ir, ow)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if tok.RefreshToken != fakeRefreshToken {
+        t.Errorf("Got refresh token %q, expected %q", tok.RefreshToken, fakeRefreshToken)
+    }
+}
+
+func TestAuthorizePasteRefused(t *testing.T) {
+    s := makeFakeAuthServer()
+    defer s.Close()
+
+    // Nil stands for any error.
+    for in, want := range map[string]error{
+        "": io.EOF,
+        pasteRedirectURL + "?code=code&state=forged": ErrAuthState,
+        pasteRedirectURL + "?state=forged\n":         ErrAuthState,
+        "%zz\n":                                      nil,
+    } {
+        _, err := authorizePaste(s.config(), strings.NewReader(in), ioutil.Discard)
+        if err == nil || want != nil && err != want {
+            t.Errorf("Pasted %q got %v, expected %v", in, err, want)
+        }
+    }
+    if n := s.exchanged(); n != 0 {
+        t.Errorf("Exchanged the code %d times, expected never", n)
+    }
+}
+
+func TestAuthVerifier(t *testing.T) {
+    s := makeFakeAuthServer()
+    defer s.Close()
+    a, err := makeAuthRequest(s.config(), pasteRedirectURL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    loc, err := s.redirect(a.URL())
+    if err != nil {
+        t.Fatal(err)
+    }
+    u, err := url.Parse(loc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    q := u.Query()
+
+    // The code is worthless without the verifier of the request.
+    other := *a
+    other.verifier, _ = randomString(32)
+    if _, err := other.exchange(q); err == nil {
+        t.Error("Code exchanged with another verifier")
+    }
+    if _, err := a.exchange(url.Values{"state": {a.state}}); err != ErrAuthNoCode {
+        t.Errorf("Redirect without the code got %v, expected %v", err, ErrAuthNoCode)
+    }
+    denied := url.Values{"state": {a.state}, "error": {"access_denied"}}
+    if _, err := a.exchange(denied); err == nil {
+        t.Error("Refused authorization succeeded")
+    }
+    if _, err := a.exchange(q); err != nil {
+        t.Fatal(err)
+    }
+    if n := s.exchanged(); n != 1 {
+        t.Errorf("Exchanged the code %d times, expected once", n)
+    }
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+    defer func(d time.Duration) { deviceInterval = d }(deviceInterval)
+    deviceInterval = 20 * time.Millisecond
+    s := makeFakeAuthServer()
+    defer s.Close()
+
+    // The code without expiry is valid for the default time.
+    s.polls = []string{"authorization_pending", "slow_down", "authorization_pending", ""}
+    out := &bytes.Buffer{}
+    tok, err := authorizeDevice(s.config(), s.URL+"/device", out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if tok.RefreshToken != fakeRefreshToken || tok.Expiry.IsZero() {
+        t.Errorf("Got token %+v", tok)
+    }
+    if !strings.Contains(out.String(), s.URL+"/verify") || !strings.Contains(out.String(), "USER-CODE") {
+        t.Errorf("Printed %q without the address and the code", out.String())
+    }
+    polled := s.pollTimes()
+    if len(polled) != 4 {
+        t.Fatalf("Polled %d times, expected 4", len(polled))
+    }
+    if gap := polled[3].Sub(polled[2]); gap < 2*deviceInterval {
+        t.Errorf("Polled again after %v when asked to slow down", gap)
+    }
+}
+
+func TestAuthorizeDeviceRefused(t *testing.T) {
+    defer func(d time.Duration) { deviceInterval = d }(deviceInterval)
+    deviceInterval = 20 * time.Millisecond
+    s := makeFakeAuthServer()
+    defer s.Close()
+
+    s.polls = []string{"authorization_pending", "access_denied"}
+    _, err := authorizeDevice(s.config(), s.URL+"/device", ioutil.Discard)
+    if err == nil || !strings.Contains(err.Error(), "access_denied") {
+        t.Errorf("Denied access got %v", err)
+    }
+    if n := len(s.pollTimes()); n != 2 {
+        t.Errorf("Polled %d times, expected 2", n)
+    }
+
+    s.Lock()
+    s.expiresIn = 1
+    s.polls = []string{"authorization_pending"}
+    s.Unlock()
+    if _, err := authorizeDevice(s.config(), s.URL+"/device", ioutil.Discard); err != ErrAuthTimeout {
+        t.Errorf("Expired code got %v, expected %v", err, ErrAuthTimeout)
+    }
+    if _, err := authorizeDevice(s.config(), s.URL+"/nowhere", ioutil.Discard); err == nil {
+        t.Error("Device flow succeeded without the device code")
+    }
+}
+
+// JSON key of a service account with a new private key, the tokens are
+// issued by tokenURL.
+func makeServiceAccountKey(t *testing.T, tokenURL string) []byte {
+    pk, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKCS8PrivateKey(pk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, err := json.Marshal(serviceAccountKey{
+        Type:         "service_account",
+        PrivateKeyId: "key",
+        PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+        ClientEmail:  fakeAccountEmail,
+        TokenURI:     tokenURL,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+func TestServiceAccountKey(t *testing.T) {
+    data := makeServiceAccountKey(t, "")
+    if _, err := parseServiceAccountKey(data); err != nil {
+        t.Fatal(err)
+    }
+    var key serviceAccountKey
+    json.Unmarshal(data, &key)
+
+    user := key
+    user.Type = "authorized_user"
+    noEmail := key
+    noEmail.ClientEmail = ""
+    noPEM := key
+    noPEM.PrivateKey = "MIIEvQIBADANBgkqhkiG9w0BAQEFAASC"
+    badPEM := key
+    badPEM.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")}))
+
+    // Nil stands for any error.
+    for _, c := range []struct {
+        key  serviceAccountKey
+        want error
+    }{{user, ErrBadKey}, {noEmail, ErrBadKey}, {noPEM, nil}, {badPEM, nil}} {
+        data, _ := json.Marshal(c.key)
+        if _, err := parseServiceAccountKey(data); err == nil || c.want != nil && err != c.want {
+            t.Errorf("Key %+v got %v, expected %v", c.key, err, c.want)
+        }
+    }
+    if _, err := parseServiceAccountKey([]byte("{")); err == nil {
+        t.Error("Broken JSON parsed")
+    }
+}
+
+func TestServiceAccountSource(t *testing.T) {
+    s := makeFakeAuthServer()
+    defer s.Close()
+    dir, err := ioutil.TempDir("", "grivefs-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    data := makeServiceAccountKey(t, s.URL+"/token")
+    if err := ioutil.WriteFile(dir+"/key.json", data, 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, c := range []struct {
+        path     string
+        readOnly bool
+        subject  string
+        scope    string
+    }{
+        {"key.json", false, "", Scope},
+        {dir + "/key.json", true, "user@example.com", ReadOnlyScope},
+    } {
+        conf := newConfig(dir+"/config.json", dir)
+        conf.ServiceAccount = c.path
+        conf.ReadOnly = c.readOnly
+        conf.Subject = c.subject
+        src, err := serviceAccountSource(conf)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := src.Token(); err != nil {
+            t.Fatal(err)
+        }
+        claims := s.claimed()
+        if claims["iss"] != fakeAccountEmail || claims["scope"] != c.scope {
+            t.Errorf("Key %s claimed %v, expected the scope %s", c.path, claims, c.scope)
+        }
+        if sub, _ := claims["sub"].(string); sub != c.subject {
+            t.Errorf("Key %s claimed the subject %q, expected %q", c.path, sub, c.subject)
+        }
+    }
+
+    // The relative path is not in the working directory.
+    conf := newConfig(dir+"/config.json", os.TempDir())
+    conf.ServiceAccount = "key.json"
+    if _, err := serviceAccountSource(conf); err == nil {
+        t.Error("Key found outside the data directory")
+    }
+}
@@ -0,0 +1,46 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    drive "google.golang.org/api/drive/v2"
+    "io"
+)
+
+// Everything the file system needs from the drive, Remote talks to
+// google drive and MemRemote of the tests keeps the files in memory so
+// the file system can be tested without google.
+type DriveBackend interface {
+    // The root folder of the drive.
+    GetRootFile() (*drive.File, error)
+    // All the files in the directory.
+    ListDir(dir *drive.File) ([]*drive.File, error)
+    // All the files shared with the user.
+    ListShared() ([]*drive.File, error)
+    // The root folders of the shared drives of the user.
+    ListDrives() ([]*drive.File, error)
+    // Current metadata of the file.
+    GetFileInfo(fileId string) (*drive.File, error)
+    // Token of the current position in the changes feed.
+    StartPageToken() (string, error)
+    // Changes since the token and the token for the next call.
+    ListChanges(token string) ([]*drive.Change, string, error)
+    // Creates a new file with the content read from r.
+    Upload(f *drive.File, r io.Reader) (*drive.File, error)
+    // Uploads the content read from r as a new revision of f.
+    Update(f *drive.File, r io.Reader) (*drive.File, error)
+    // Creates a new directory in parent.
+    Mkdir(parent *drive.File, title string) (*drive.File, error)
+    // Renames the file and moves it between parents.
+    Move(f *drive.File, title string, from string, to string) (*drive.File, error)
+    // Moves the file to the trash.
+    Trash(f *drive.File) error
+    // Deletes the file permanently.
+    Delete(f *drive.File) error
+    // Downloads size bytes of the content from off, 0 means to the end.
+    Download(f *drive.File, off int64, size int64) (io.ReadCloser, error)
+    // Downloads the Google Apps file converted to the mime type.
+    Export(f *drive.File, mime string) (io.ReadCloser, error)
+}
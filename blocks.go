@@ -0,0 +1,83 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "errors"
+    "io/ioutil"
+    "path"
+)
+
+const (
+    BlockSize = 1 << 20
+)
+
+// Bitmap of the blocks of a file present in its sparse local copy. It
+// is stored in a file next to the local copy so a partially downloaded
+// file survives a restart, the file is removed once all the blocks are
+// present.
+type blockMap struct {
+    path    string
+    count   int64
+    present int64
+    bits    []byte
+}
+
+// Path of the block map of the local copy called name.
+func blockMapPath(dir string, name string) string {
+    return path.Join(dir, "."+name+".blocks")
+}
+
+// Empty block map of a file having size bytes.
+func newBlockMap(p string, size int64) *blockMap {
+    count := (size + BlockSize - 1) / BlockSize
+    return &blockMap{
+        path:  p,
+        count: count,
+        bits:  make([]byte, (count+7)/8),
+    }
+}
+
+//
+func loadBlockMap(p string, size int64) (*blockMap, error) {
+    data, err := ioutil.ReadFile(p)
+    if err != nil {
+        return nil, err
+    }
+    m := newBlockMap(p, size)
+    if len(data) != len(m.bits) {
+        return nil, errors.New("Block map doesn't match the file size")
+    }
+    m.bits = data
+    for i := int64(0); i < m.count; i++ {
+        if m.has(i) {
+            m.present++
+        }
+    }
+    return m, nil
+}
+
+//
+func (m *blockMap) save() error {
+    return ioutil.WriteFile(m.path, m.bits, 0600)
+}
+
+//
+func (m *blockMap) has(i int64) bool {
+    return m.bits[i/8]&(1<<uint(i%8)) != 0
+}
+
+//
+func (m *blockMap) set(i int64) {
+    if !m.has(i) {
+        m.bits[i/8] |= 1 << uint(i%8)
+        m.present++
+    }
+}
+
+//
+func (m *blockMap) complete() bool {
+    return m.present == m.count
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "io/ioutil"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Prefix of the copies of the local changes which couldn't be
+// uploaded.
+const conflictPrefix = ".conflict-"
+
+type cacheEntry struct {
+    size     int64
+    access   time.Time
+    opened   int
+    conflict bool
+}
+
+// Index of the files in the cache directory. It keeps the last access
+// of every file so that the least recently used files can be evicted
+// once the cache grows over its size limit, it doesn't rely on the
+// atime of the files which is not updated on noatime mounts. The
+// conflict copies count toward the limit too, but they are evicted
+// only when they expire.
+type fileCache struct {
+    // Number of downloaded files which didn't match their checksum,
+    // first to keep it aligned for the atomic access.
+    mismatches uint64
+    sync.Mutex
+    dir      string
+    ttl      time.Duration
+    maxSize  int64
+    size     int64
+    entries  map[string]*cacheEntry
+    cleaning int32
+}
+
+//
+func MakeFileCache(dir string, ttl time.Duration, maxSize int64) *fileCache {
+    c := &fileCache{
+        dir:     dir,
+        ttl:     ttl,
+        maxSize: maxSize,
+        entries: make(map[string]*cacheEntry),
+    }
+    if err := c.scan(); err != nil && !os.IsNotExist(err) {
+        log.WithFields(log.Fields{
+            "func": "cache.go:MakeFileCache",
+            "dir":  dir}).Warn(err)
+    }
+    return c
+}
+
+// Syncs the index with the files in the cache directory. Files not in
+// the index yet get their atime as the last access, the best guess
+// there is for files cached before the start.
+func (c *fileCache) scan() error {
+    fs, err := ioutil.ReadDir(c.dir)
+    if err != nil {
+        return err
+    }
+    c.Lock()
+    defer c.Unlock()
+    seen := make(map[string]bool)
+    c.size = 0
+    for _, fi := range fs {
+        name := fi.Name()
+        conflict := strings.HasPrefix(name, conflictPrefix)
+        // Staging files and such are not part of the cache.
+        if name[0] == '.' && !conflict || fi.IsDir() {
+            continue
+        }
+        seen[name] = true
+        e, ok := c.entries[name]
+        if !ok {
+            e = &cacheEntry{access: atime(fi), conflict: conflict}
+            c.entries[name] = e
+        }
+        e.size = diskUsage(fi)
+        c.size += e.size
+    }
+    for name, e := range c.entries {
+        if !seen[name] && e.opened == 0 {
+            delete(c.entries, name)
+        }
+    }
+    return nil
+}
+
+// The caller holds the lock.
+func (c *fileCache) entry(name string) *cacheEntry {
+    e, ok := c.entries[name]
+    if !ok {
+        e = &cacheEntry{}
+        c.entries[name] = e
+    }
+    return e
+}
+
+// Records an access to the file.
+func (c *fileCache) touch(name string) {
+    c.Lock()
+    c.entry(name).access = time.Now()
+    c.Unlock()
+}
+
+// The file was opened, it can't be evicted until it is closed.
+func (c *fileCache) open(name string) {
+    c.Lock()
+    e := c.entry(name)
+    e.opened++
+    e.access = time.Now()
+    c.Unlock()
+}
+
+// The file failed to open, it can be evicted again.
+func (c *fileCache) cancel(name string) {
+    c.Lock()
+    c.entry(name).opened--
+    c.Unlock()
+}
+
+// The file was closed taking size bytes on the disk, the cache is
+// cleaned when it is over the limit.
+func (c *fileCache) close(name string, size int64) {
+    c.Lock()
+    e := c.entry(name)
+    e.opened--
+    e.access = time.Now()
+    c.size += size - e.size
+    e.size = size
+    over := c.maxSize > 0 && c.size > c.maxSize
+    c.Unlock()
+    if over {
+        go c.clean()
+    }
+}
+
+// The file was renamed in the cache directory.
+func (c *fileCache) rename(old string, name string) {
+    c.Lock()
+    defer c.Unlock()
+    if e, ok := c.entries[old]; ok {
+        delete(c.entries, old)
+        c.entries[name] = e
+    }
+}
+
+// Removes the files which were not accessed for longer than the ttl
+// and then the least recently used ones until the cache fits in its
+// size limit. Files with open handles are never removed.
+func (c *fileCache) clean() {
+    if !atomic.CompareAndSwapInt32(&c.cleaning, 0, 1) {
+        return
+    }
+    defer atomic.StoreInt32(&c.cleaning, 0)
+
+    logger := log.WithFields(log.Fields{
+        "func": "cache.go:clean",
+        "dir":  c.dir})
+    logger.Debug("Cleaning cache...")
+    if err := c.scan(); err != nil {
+        logger.Error(err)
+        return
+    }
+
+    c.Lock()
+    defer c.Unlock()
+    lru := make(byAccess, 0, len(c.entries))
+    for name, e := range c.entries {
+        if e.opened == 0 {
+            lru = append(lru, entryName{name, e})
+        }
+    }
+    sort.Sort(lru)
+
+    for _, en := range lru {
+        expired := c.ttl > 0 && time.Since(en.access) > c.ttl
+        if !expired && (c.maxSize <= 0 || c.size <= c.maxSize) {
+            break
+        }
+        // The only copy of the changes is not evicted to make room.
+        if !expired && en.conflict {
+            continue
+        }
+        logger.WithField("file", en.name).Debug("Removing file")
+        err := os.Remove(path.Join(c.dir, en.name))
+        if err != nil && !os.IsNotExist(err) {
+            logger.WithField("file", en.name).Warn(err)
+            continue
+        }
+        os.Remove(blockMapPath(c.dir, en.name))
+        c.size -= en.size
+        delete(c.entries, en.name)
+    }
+    logger.Debugf("Cleaning cache done, %d bytes cached.", c.size)
+}
+
+type entryName struct {
+    name string
+    *cacheEntry
+}
+
+// Sorts the entries from the least recently accessed.
+type byAccess []entryName
+
+func (a byAccess) Len() int           { return len(a) }
+func (a byAccess) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAccess) Less(i, j int) bool { return a[i].access.Before(a[j].access) }
@@ -0,0 +1,103 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "io/ioutil"
+    "math/rand"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Writes the cache files last accessed the minutes ago, it returns
+// the disk usage of one file.
+func makeCacheFiles(t *testing.T, dir string, ages map[string]int) int64 {
+    content := make([]byte, 8192)
+    rand.Read(content)
+    var usage int64
+    for name, age := range ages {
+        p := path.Join(dir, name)
+        if err := ioutil.WriteFile(p, content, 0600); err != nil {
+            t.Fatal(err)
+        }
+        at := time.Now().Add(-time.Duration(age) * time.Minute)
+        if err := os.Chtimes(p, at, at); err != nil {
+            t.Fatal(err)
+        }
+        fi, err := os.Stat(p)
+        if err != nil {
+            t.Fatal(err)
+        }
+        usage = diskUsage(fi)
+    }
+    return usage
+}
+
+// Names of the files left in the cache directory.
+func cachedNames(t *testing.T, dir string) string {
+    fs, err := ioutil.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, fi := range fs {
+        names = append(names, fi.Name())
+    }
+    sort.Strings(names)
+    return strings.Join(names, " ")
+}
+
+func TestCacheEvictsLRU(t *testing.T) {
+    dir, err := ioutil.TempDir("", "grivefs-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    usage := makeCacheFiles(t, dir, map[string]int{
+        conflictPrefix + "x-1": 4, "a": 3, "b": 2, "c": 1})
+
+    // The conflict copy counts, but it is not evicted to make room and
+    // neither is the opened file.
+    c := MakeFileCache(dir, time.Hour, 2*usage)
+    c.open("b")
+    c.clean()
+    if got, want := cachedNames(t, dir), conflictPrefix+"x-1 b"; got != want {
+        t.Errorf("Cache has %q, expected %q", got, want)
+    }
+    if c.size != 2*usage {
+        t.Errorf("Cache takes %d bytes, expected %d", c.size, 2*usage)
+    }
+
+    // Once closed the file is evicted like any other.
+    c.close("b", usage)
+    makeCacheFiles(t, dir, map[string]int{"d": 0})
+    c.clean()
+    if got, want := cachedNames(t, dir), conflictPrefix+"x-1 d"; got != want {
+        t.Errorf("Cache has %q, expected %q", got, want)
+    }
+}
+
+func TestCacheExpires(t *testing.T) {
+    dir, err := ioutil.TempDir("", "grivefs-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    makeCacheFiles(t, dir, map[string]int{
+        conflictPrefix + "x-1": 4, "a": 3, "b": 2, ".staging": 5})
+
+    // Without a size limit only the expired files go, the conflict
+    // copies too. Staging files are not part of the cache.
+    c := MakeFileCache(dir, 150*time.Second, 0)
+    c.open("a")
+    c.clean()
+    if got, want := cachedNames(t, dir), ".staging a b"; got != want {
+        t.Errorf("Cache has %q, expected %q", got, want)
+    }
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+import (
+    "bazil.org/fuse/fs"
+    log "github.com/Sirupsen/logrus"
+    drive "google.golang.org/api/drive/v2"
+    "google.golang.org/api/googleapi"
+    "net/http"
+    "time"
+)
+
+// Periodically asks the drive for the changes made since the last
+// poll and applies them to the in memory tree.
+func (g *griveFS) pollChanges() {
+    logger := log.WithField("func", "changes.go:pollChanges")
+    ticker := time.NewTicker(time.Duration(g.c.ChangePollT) * time.Second)
+    logger.Info("Change poller started")
+    // Catch up with the changes made while not mounted.
+    g.syncChanges()
+    for {
+        select {
+        case <-ticker.C:
+            g.syncChanges()
+        case <-g.done:
+            ticker.Stop()
+            logger.Info("Change poller stopped")
+            return
+        }
+    }
+}
+
+//
+func (g *griveFS) syncChanges() {
+    logger := log.WithField("func", "changes.go:syncChanges")
+    cs, tok, err := g.remote.ListChanges(g.changeTok)
+    if err != nil {
+        logger.Warn(err)
+        if badToken(err) {
+            g.resync()
+        }
+        return
+    }
+    logger.Debugf("Applying %d changes", len(cs))
+    for _, c := range cs {
+        g.applyChange(c)
+    }
+    if tok != "" {
+        g.changeTok = tok
+        g.meta.setToken(tok)
+    }
+    if err := g.meta.save(); err != nil {
+        logger.Warn(err)
+    }
+}
+
+// Whether the drive refused the change token, it expired or is not
+// valid and the changes since it are lost.
+func badToken(err error) bool {
+    e, ok := err.(*googleapi.Error)
+    return ok && (e.Code == http.StatusBadRequest ||
+        e.Code == http.StatusNotFound || e.Code == http.StatusGone)
+}
+
+// Starts over with a new change token when the old one can't be used,
+// the stored metadata is dropped and the loaded directories are listed
+// again so they pick up the changes which were lost.
+func (g *griveFS) resync() {
+    logger := log.WithField("func", "changes.go:resync")
+    logger.Warn("Change token refused, listing the directories again")
+    tok, err := g.remote.StartPageToken()
+    if err != nil {
+        logger.Warn(err)
+        return
+    }
+    g.root.RLock()
+    root := g.root.rf
+    g.root.RUnlock()
+    g.meta.reset()
+    g.meta.setRoot(root)
+    g.changeTok = tok
+    g.meta.setToken(tok)
+
+    // The virtual directories are not registered by id.
+    dirs := append([]*grvDir(nil), g.virtual...)
+    g.idsLock.Lock()
+    for _, ns := range g.ids {
+        for _, n := range ns {
+            if d, ok := n.(*grvDir); ok {
+                dirs = append(dirs, d)
+            }
+        }
+    }
+    g.idsLock.Unlock()
+    for _, d := range dirs {
+        if !d.isLoaded() {
+            continue
+        }
+        d.loading.Lock()
+        if err := d.loadDirContent(); err != nil {
+            logger.WithField("dir", d.name).Warn(err)
+        }
+        d.loading.Unlock()
+    }
+}
+
+// Brings all the nodes of the changed file in line with the new
+// metadata, the file is removed from directories it is no longer in
+// and added to the ones it appeared in. Directories not listed yet are
+// skipped, they get the file when they are loaded.
+func (g *griveFS) applyChange(c *drive.Change) {
+    logger := log.WithFields(log.Fields{
+        "func":        "changes.go:applyChange",
+        "remote_file": c.FileId})
+
+    if c.Type == "drive" {
+        // The shared drive changes as its root folder.
+        dc := &drive.Change{FileId: c.DriveId, Deleted: c.Deleted}
+        if c.Drive != nil {
+            dc.File = driveFile(c.Drive)
+        }
+        c = dc
+    }
+    if c.Deleted || c.File == nil {
+        g.meta.remove(c.FileId)
+    } else {
+        g.meta.put(c.File)
+    }
+    if c.Deleted || c.File == nil || RemoteIsHidden(c.File) {
+        for _, n := range g.nodesOf(c.FileId) {
+            logger.Debug("Removing deleted file")
+            g.removeNode(n)
+        }
+        return
+    }
+
+    f := c.File
+    seen := make(map[*grvDir]bool)
+    for _, n := range g.nodesOf(f.Id) {
+        for _, p := range nodeOf(n).parentDirs() {
+            if p.holds(f) {
+                seen[p] = true
+                continue
+            }
+            logger.Debugf("Removing file moved away from %s", p.name)
+            g.unlink(n, p)
+        }
+        updateNode(n, f)
+    }
+
+    for _, pr := range f.Parents {
+        for _, n := range g.nodesOf(pr.Id) {
+            p, ok := n.(*grvDir)
+            if !ok || seen[p] || !p.isLoaded() {
+                continue
+            }
+            logger.Debugf("Adding file %s to %s", f.Title, p.name)
+            p.addfile(g.nodeFor(f))
+        }
+    }
+    for _, p := range g.virtual {
+        if p.filter == nil || seen[p] || !p.isLoaded() || !p.filter(f) {
+            continue
+        }
+        logger.Debugf("Adding file %s to %s", f.Title, p.name)
+        p.addfile(g.nodeFor(f))
+    }
+}
+
+// Detaches the node from all its directories and forgets it.
+func (g *griveFS) removeNode(n fs.Node) {
+    for _, p := range nodeOf(n).parentDirs() {
+        p.rmfile(n)
+    }
+    g.forget(n)
+}
+
+// Takes the node out of the directory, it is forgotten once it is in
+// no directory.
+func (g *griveFS) unlink(n fs.Node, p *grvDir) {
+    p.rmfile(n)
+    if len(nodeOf(n).parentDirs()) == 0 {
+        g.forget(n)
+    }
+}
@@ -18,16 +18,83 @@ const (
     cfg_file      = ".config.json"
     cache_ttl     = 24
     cache_clean_t = 3600
+    cache_max     = 1 << 30
+    change_poll_t = 60
+    dir_ttl       = 300
+    max_retries   = 5
+    qps           = 10
+    shared_dir    = ".shared"
+    drives_dir    = ".drives"
 )
 
 type Config struct {
-    ClientId     string `json:"client_id"`
-    ClientSecret string `json:"client_secret"`
-    RefreshToken string `json:"refresh_token"`
-    CacheTTL     int    `json:"cache_ttl"`
-    CacheCleanT  int    `json:"cache_clean_t"`
-    Path         string `json:"-"`
-    DataDir      string `json:"-"`
+    ClientId     string  `json:"client_id"`
+    ClientSecret string  `json:"client_secret"`
+    RefreshToken string  `json:"refresh_token"`
+    CacheTTL     int     `json:"cache_ttl"`
+    CacheCleanT  int     `json:"cache_clean_t"`
+    CacheMaxSize int64   `json:"cache_max_bytes"`
+    ChangePollT  int     `json:"change_poll_t"`
+    DirTTL       int     `json:"dir_ttl"`
+    HardDelete   bool    `json:"hard_delete"`
+    MaxRetries   int     `json:"max_retries"`
+    QPS          float64 `json:"qps"`
+    ExportDocs   bool    `json:"export_docs"`
+    // Extension of the export format by the Google Apps mime type.
+    ExportFormats map[string]string `json:"export_formats"`
+    // Replacements of the parts of the titles not allowed in names.
+    NameRules map[string]string `json:"name_rules"`
+    // JSON key of the service account used instead of the user, a
+    // relative path is in the grivefs directory.
+    ServiceAccount string `json:"service_account"`
+    // User the service account acts for, empty for itself.
+    Subject string `json:"subject"`
+    // Name of the directory with the files shared with the user, empty
+    // hides it.
+    SharedDir string `json:"shared_dir"`
+    // Name of the directory with the shared drives, empty hides it.
+    DrivesDir string `json:"drives_dir"`
+    // Name or id of the shared drive mounted instead of My Drive.
+    Drive string `json:"-"`
+    // Id or path of the folder mounted instead of the drive root.
+    Root string `json:"-"`
+    // Mounted read-only.
+    ReadOnly bool `json:"-"`
+    // Authorize by pasting the redirected address, no listener.
+    Headless bool   `json:"-"`
+    Path     string `json:"-"`
+    DataDir  string `json:"-"`
+}
+
+// Config with the default values, the fields missing in the config
+// file keep these.
+func newConfig(cfgPath string, dataDir string) *Config {
+    return &Config{
+        ClientId:     client_id,
+        ClientSecret: client_secret,
+        RefreshToken: refresh_token,
+        CacheTTL:     cache_ttl,
+        CacheCleanT:  cache_clean_t,
+        CacheMaxSize: cache_max,
+        ChangePollT:  change_poll_t,
+        DirTTL:       dir_ttl,
+        MaxRetries:   max_retries,
+        QPS:          qps,
+        ExportFormats: map[string]string{
+            "application/vnd.google-apps.document":     "docx",
+            "application/vnd.google-apps.spreadsheet":  "xlsx",
+            "application/vnd.google-apps.presentation": "pptx",
+            "application/vnd.google-apps.drawing":      "pdf",
+        },
+        NameRules: map[string]string{
+            "/":    "\u2215",
+            "\x00": "\u2400",
+        },
+        SharedDir: shared_dir,
+        DrivesDir: drives_dir,
+        Path:      cfgPath,
+        DataDir:   dataDir,
+    }
 }
 
 func loadConfig(absPath string) (*Config, error) {
@@ -36,7 +103,7 @@ func loadConfig(absPath string) (*Config, error) {
     if data, err = ioutil.ReadFile(absPath); err != nil {
         return nil, err
     }
-    c := &Config{}
+    c := newConfig(absPath, path.Dir(absPath))
     err = json.Unmarshal(data, c)
     c.Path = absPath
     return c, err
@@ -59,8 +126,7 @@ func Initialize(absPath string) (*Config, error) {
     _, err := os.Stat(p)
     // No connection file found
     if err != nil {
-        c = &Config{client_id, client_secret, refresh_token,
-            cache_ttl, cache_clean_t, p, absPath}
+        c = newConfig(p, absPath)
         err = nil
     } else {
         c, err = loadConfig(p)
@@ -0,0 +1,484 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    drive "google.golang.org/api/drive/v2"
+    "io/ioutil"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    fakeApiPath  = "/drive/v2/"
+    fakePageSize = 100
+    fakeChunk    = 4096
+)
+
+var parentsQuery = regexp.MustCompile(`^'([^']+)' in parents$`)
+
+// Drive v2 REST API served over httptest so the real Remote can be
+// used without google. It serves about, files.list with the "'id' in
+// parents" and "sharedWithMe" queries, the shared drives, files.get,
+// the changes feed and the download links. The new files, the new
+// revisions, the moves, the trash and the deletes are served too, the
+// files are kept in the embedded MemRemote. Errors, rate limits, slow
+// and broken bodies can be injected.
+type FakeDrive struct {
+    *MemRemote
+    // Number of items on a page of files.list and changes.list.
+    PageSize int
+    srv      *httptest.Server
+    lock     sync.Mutex
+    faults   []*fakeFault
+    delay    time.Duration
+    cut      int64
+    requests []string
+}
+
+// Error returned for the requests of the path prefix, times is the
+// number of requests failed before it goes away, 0 means never.
+type fakeFault struct {
+    path       string
+    code       int
+    reason     string
+    retryAfter int
+    times      int
+}
+
+// The error body google sends, googleapi.CheckResponse decodes it.
+type fakeError struct {
+    Error fakeErrorBody `json:"error"`
+}
+
+type fakeErrorBody struct {
+    Errors  []fakeErrorItem `json:"errors"`
+    Code    int             `json:"code"`
+    Message string          `json:"message"`
+}
+
+type fakeErrorItem struct {
+    Domain  string `json:"domain"`
+    Reason  string `json:"reason"`
+    Message string `json:"message"`
+}
+
+// Starts the server with an empty drive, it must be closed with Close.
+func MakeFakeDrive() *FakeDrive {
+    d := &FakeDrive{
+        MemRemote: MakeMemRemote(),
+        PageSize:  fakePageSize,
+    }
+    d.srv = httptest.NewServer(d)
+    return d
+}
+
+// Remote talking to the fake drive.
+func (d *FakeDrive) Remote(c *Config) (*Remote, error) {
+    return MakeRemoteFromClient(c, d.srv.Client(), d.srv.URL+fakeApiPath)
+}
+
+// URL of the server.
+func (d *FakeDrive) URL() string {
+    return d.srv.URL
+}
+
+//
+func (d *FakeDrive) Close() {
+    d.srv.Close()
+}
+
+// Fails the requests of the path prefix with the code and reason, the
+// path is relative to the server root, e.g. /drive/v2/files or
+// /download/.
+func (d *FakeDrive) Fail(path string, code int, reason string, times int) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    d.faults = append(d.faults, &fakeFault{path, code, reason, 0, times})
+}
+
+// Fails the requests of the path prefix the way google does when the
+// user is over the quota, retryAfter sets the Retry-After header in
+// seconds when it is not 0.
+func (d *FakeDrive) RateLimit(path string, retryAfter int, times int) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    d.faults = append(d.faults, &fakeFault{
+        path, http.StatusForbidden, "userRateLimitExceeded", retryAfter, times})
+}
+
+// Sleeps for delay after every 4 kB of the downloaded content.
+func (d *FakeDrive) SlowBodies(delay time.Duration) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    d.delay = delay
+}
+
+// Drops the connection after n bytes of the downloaded content, 0
+// means the whole content is sent.
+func (d *FakeDrive) CutBodies(n int64) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    d.cut = n
+}
+
+// Number of requests served for the path prefix.
+func (d *FakeDrive) Requests(path string) int {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    n := 0
+    for _, p := range d.requests {
+        if strings.HasPrefix(p, path) {
+            n++
+        }
+    }
+    return n
+}
+
+//
+func (d *FakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    p := r.URL.Path
+    if f := d.fault(p); f != nil {
+        if f.retryAfter > 0 {
+            w.Header().Set("Retry-After", strconv.Itoa(f.retryAfter))
+        }
+        writeFakeError(w, f.code, f.reason)
+        return
+    }
+    if r.Method != "GET" {
+        d.change(w, r)
+        return
+    }
+
+    switch {
+    case p == fakeApiPath+"about":
+        writeFakeJSON(w, &drive.About{RootFolderId: memRootId})
+    case p == fakeApiPath+"files":
+        d.listFiles(w, r)
+    case p == fakeApiPath+"drives":
+        d.listDrives(w, r)
+    case strings.HasPrefix(p, fakeApiPath+"files/"):
+        f, err := d.GetFileInfo(strings.TrimPrefix(p, fakeApiPath+"files/"))
+        if err != nil {
+            writeFakeError(w, http.StatusNotFound, "notFound")
+            return
+        }
+        writeFakeJSON(w, d.links(f))
+    case p == fakeApiPath+"changes/startPageToken":
+        tok, _ := d.StartPageToken()
+        writeFakeJSON(w, &drive.StartPageToken{StartPageToken: tok})
+    case p == fakeApiPath+"changes":
+        d.listChanges(w, r)
+    case strings.HasPrefix(p, "/download/"):
+        d.download(w, r, strings.TrimPrefix(p, "/download/"))
+    default:
+        writeFakeError(w, http.StatusNotFound, "notFound")
+    }
+}
+
+// Serves the requests changing the files.
+func (d *FakeDrive) change(w http.ResponseWriter, r *http.Request) {
+    p := r.URL.Path
+    id := strings.TrimPrefix(strings.TrimPrefix(p, "/upload"), fakeApiPath+"files/")
+    var f *drive.File
+    var err error
+    switch {
+    case r.Method == "POST" && p == "/upload"+fakeApiPath+"files":
+        var meta *drive.File
+        var content []byte
+        if meta, content, err = readFakeUpload(r); err == nil {
+            f, err = d.Upload(meta, bytes.NewReader(content))
+        }
+    case r.Method == "PUT" && strings.HasPrefix(p, "/upload"+fakeApiPath+"files/"):
+        var content []byte
+        if _, content, err = readFakeUpload(r); err == nil {
+            cur := &drive.File{Id: id, Etag: r.Header.Get("If-Match")}
+            f, err = d.Update(cur, bytes.NewReader(content))
+        }
+    case r.Method == "POST" && p == fakeApiPath+"files":
+        meta := &drive.File{}
+        if err = json.NewDecoder(r.Body).Decode(meta); err == nil && len(meta.Parents) > 0 {
+            f, err = d.Mkdir(&drive.File{Id: meta.Parents[0].Id}, meta.Title)
+        }
+    case r.Method == "PATCH" && strings.HasPrefix(p, fakeApiPath+"files/"):
+        meta := &drive.File{}
+        if err = json.NewDecoder(r.Body).Decode(meta); err == nil {
+            q := r.URL.Query()
+            f, err = d.Move(&drive.File{Id: id}, meta.Title,
+                q.Get("removeParents"), q.Get("addParents"))
+        }
+    case r.Method == "POST" && strings.HasSuffix(p, "/trash"):
+        id = strings.TrimSuffix(id, "/trash")
+        if err = d.Trash(&drive.File{Id: id}); err == nil {
+            f, err = d.GetFileInfo(id)
+        }
+    case r.Method == "DELETE" && strings.HasPrefix(p, fakeApiPath+"files/"):
+        if err = d.Delete(&drive.File{Id: id}); err == nil {
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+    default:
+        writeFakeError(w, http.StatusNotImplemented, "notImplemented")
+        return
+    }
+    switch {
+    case err == ErrMemNotFound:
+        writeFakeError(w, http.StatusNotFound, "notFound")
+    case err == ErrConflict:
+        writeFakeError(w, http.StatusPreconditionFailed, "conditionNotMet")
+    case err != nil:
+        writeFakeError(w, http.StatusBadRequest, "invalid")
+    default:
+        writeFakeJSON(w, d.links(f))
+    }
+}
+
+// The metadata and the content of a multipart upload.
+func readFakeUpload(r *http.Request) (*drive.File, []byte, error) {
+    _, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if err != nil {
+        return nil, nil, err
+    }
+    mr := multipart.NewReader(r.Body, params["boundary"])
+    part, err := mr.NextPart()
+    if err != nil {
+        return nil, nil, err
+    }
+    meta := &drive.File{}
+    if err := json.NewDecoder(part).Decode(meta); err != nil {
+        return nil, nil, err
+    }
+    if part, err = mr.NextPart(); err != nil {
+        return nil, nil, err
+    }
+    content, err := ioutil.ReadAll(part)
+    return meta, content, err
+}
+
+// Records the request and returns the fault injected for it, if any.
+func (d *FakeDrive) fault(path string) *fakeFault {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    d.requests = append(d.requests, path)
+    for i, f := range d.faults {
+        if !strings.HasPrefix(path, f.path) {
+            continue
+        }
+        if f.times > 0 {
+            f.times--
+            if f.times == 0 {
+                d.faults = append(d.faults[:i], d.faults[i+1:]...)
+            }
+        }
+        return f
+    }
+    return nil
+}
+
+//
+func (d *FakeDrive) listFiles(w http.ResponseWriter, r *http.Request) {
+    var fs []*drive.File
+    q := r.URL.Query().Get("q")
+    if q == "sharedWithMe" {
+        fs, _ = d.ListShared()
+    } else if m := parentsQuery.FindStringSubmatch(q); m != nil {
+        fs, _ = d.ListDir(&drive.File{Id: m[1]})
+    } else {
+        writeFakeError(w, http.StatusBadRequest, "invalidQuery")
+        return
+    }
+    sort.Sort(byTitle(fs))
+    first, last, next, ok := d.page(r, len(fs))
+    if !ok {
+        writeFakeError(w, http.StatusBadRequest, "invalid")
+        return
+    }
+    l := &drive.FileList{NextPageToken: next}
+    for _, f := range fs[first:last] {
+        l.Items = append(l.Items, d.links(f))
+    }
+    writeFakeJSON(w, l)
+}
+
+//
+func (d *FakeDrive) listDrives(w http.ResponseWriter, r *http.Request) {
+    fs, _ := d.ListDrives()
+    sort.Sort(byTitle(fs))
+    first, last, next, ok := d.page(r, len(fs))
+    if !ok {
+        writeFakeError(w, http.StatusBadRequest, "invalid")
+        return
+    }
+    l := &drive.DriveList{NextPageToken: next}
+    for _, f := range fs[first:last] {
+        dr := &drive.Drive{Id: f.Id, Name: f.Title, CreatedDate: f.CreatedDate}
+        if c := f.Capabilities; c != nil {
+            dr.Capabilities = &drive.DriveCapabilities{
+                CanAddChildren:  c.CanAddChildren,
+                CanDownload:     c.CanDownload,
+                CanEdit:         c.CanEdit,
+                CanListChildren: c.CanListChildren,
+            }
+        }
+        l.Items = append(l.Items, dr)
+    }
+    writeFakeJSON(w, l)
+}
+
+//
+func (d *FakeDrive) listChanges(w http.ResponseWriter, r *http.Request) {
+    tok := r.URL.Query().Get("pageToken")
+    cs, newTok, err := d.ListChanges(tok)
+    if err != nil {
+        writeFakeError(w, http.StatusBadRequest, "invalid")
+        return
+    }
+    // The page token of the changes is the position in the feed.
+    start, _ := strconv.Atoi(tok)
+    n := d.PageSize
+    if n <= 0 || n > len(cs) {
+        n = len(cs)
+    }
+    l := &drive.ChangeList{}
+    for _, c := range cs[:n] {
+        nc := *c
+        if c.File != nil {
+            nc.File = d.links(c.File)
+        }
+        l.Items = append(l.Items, &nc)
+    }
+    if n < len(cs) {
+        l.NextPageToken = strconv.Itoa(start + n)
+    } else {
+        l.NewStartPageToken = newTok
+    }
+    writeFakeJSON(w, l)
+}
+
+// Range of the items on the requested page and the token of the next
+// page.
+func (d *FakeDrive) page(r *http.Request, count int) (int, int, string, bool) {
+    first := 0
+    if t := r.URL.Query().Get("pageToken"); t != "" {
+        var err error
+        if first, err = strconv.Atoi(t); err != nil || first < 0 || first > count {
+            return 0, 0, "", false
+        }
+    }
+    size := d.PageSize
+    if m, err := strconv.Atoi(r.URL.Query().Get("maxResults")); err == nil && m > 0 {
+        if size <= 0 || m < size {
+            size = m
+        }
+    }
+    last := count
+    if size > 0 && first+size < count {
+        last = first + size
+    }
+    next := ""
+    if last < count {
+        next = strconv.Itoa(last)
+    }
+    return first, last, next, true
+}
+
+// Serves the content with the Range header honoured, slowed down or
+// cut when asked to.
+func (d *FakeDrive) download(w http.ResponseWriter, r *http.Request, id string) {
+    content, err := d.Content(id)
+    if err != nil {
+        writeFakeError(w, http.StatusNotFound, "notFound")
+        return
+    }
+    size := int64(len(content))
+    first, last := int64(0), size-1
+    status := http.StatusOK
+    if rg := r.Header.Get("Range"); rg != "" {
+        n, _ := fmt.Sscanf(rg, "bytes=%d-%d", &first, &last)
+        if n == 0 || first >= size || last < first {
+            w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+            w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+            return
+        }
+        if n == 1 || last >= size {
+            last = size - 1
+        }
+        w.Header().Set("Content-Range",
+            fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+        status = http.StatusPartialContent
+    }
+    body := content[first : last+1]
+
+    d.lock.Lock()
+    delay, cut := d.delay, d.cut
+    d.lock.Unlock()
+    w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+    w.WriteHeader(status)
+    var sent int64
+    for len(body) > 0 {
+        n := int64(fakeChunk)
+        if n > int64(len(body)) {
+            n = int64(len(body))
+        }
+        if cut > 0 && sent+n > cut {
+            w.Write(body[:cut-sent])
+            // Aborting the handler drops the connection.
+            panic(http.ErrAbortHandler)
+        }
+        if _, err := w.Write(body[:n]); err != nil {
+            return
+        }
+        body = body[n:]
+        sent += n
+        if delay > 0 {
+            w.(http.Flusher).Flush()
+            time.Sleep(delay)
+        }
+    }
+}
+
+// Points the download link of the file to the server.
+func (d *FakeDrive) links(f *drive.File) *drive.File {
+    nf := copyFile(f)
+    if !RemoteIsDir(f) && !RemoteIsDesktopFile(f) {
+        nf.DownloadUrl = d.srv.URL + "/download/" + f.Id
+    }
+    return nf
+}
+
+//
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+//
+func writeFakeError(w http.ResponseWriter, code int, reason string) {
+    msg := http.StatusText(code)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(&fakeError{fakeErrorBody{
+        Errors:  []fakeErrorItem{{"global", reason, msg}},
+        Code:    code,
+        Message: msg,
+    }})
+}
+
+type byTitle []*drive.File
+
+func (a byTitle) Len() int           { return len(a) }
+func (a byTitle) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTitle) Less(i, j int) bool { return a[i].Title < a[j].Title }
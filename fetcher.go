@@ -6,88 +6,239 @@ package main
 
 import (
     "crypto/md5"
+    "encoding/hex"
     "errors"
     "fmt"
     log "github.com/Sirupsen/logrus"
-    "github.com/bartmeuris/progressio"
+    "golang.org/x/net/context"
     drive "google.golang.org/api/drive/v2"
     "io"
+    "io/ioutil"
+    "math"
     "os"
     "path"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
 const (
-    MinDownloadSize = 65536
+    // Number of blocks downloaded ahead of what is being read.
+    ReadAhead = 4
+    // How many times a file is downloaded again when its checksum
+    // doesn't match.
+    ChecksumRetries = 3
 )
 
 type fileFetcher struct {
+    sync.Mutex
+    cache      *fileCache
     localPath  string
     rf         *drive.File
     lf         *os.File
     opened     int
+    held       bool
     inProgress int32
+    pending    *drive.File
+    dirty      bool
+    blocks     *blockMap
+    verifying  *blockMap
+    inflight   map[int64]bool
+    failed     map[int64]error
+    progress   chan struct{}
+    retries    int
+    broken     error
+    export     string
 }
 
+var ErrConflict = errors.New("File was changed on the drive")
+var ErrChecksum = errors.New("Checksum of the downloaded file doesn't match")
+
 //
-func MakeFileFetcher(dir string, rf *drive.File) *fileFetcher {
+func MakeFileFetcher(cache *fileCache, rf *drive.File) *fileFetcher {
     f := &fileFetcher{
-        localPath:  path.Join(dir, rf.Id),
+        cache:      cache,
+        localPath:  path.Join(cache.dir, rf.Id),
         rf:         rf,
         lf:         nil,
         opened:     0,
         inProgress: 0,
+        inflight:   make(map[int64]bool),
+        failed:     make(map[int64]error),
+        progress:   make(chan struct{}),
     }
     return f
 }
 
+// The Google Apps file is exported as the mime type, the local copy
+// gets the extension so it is not mistaken for another format.
+func (f *fileFetcher) exportAs(mime string, ext string) {
+    f.export = mime
+    f.localPath = f.localPath + "." + ext
+}
+
+// Fetcher of a file which is not on the drive yet, it is opened for
+// writing into a staging file which is uploaded later.
+func MakeStagingFetcher(cache *fileCache, rf *drive.File) (*fileFetcher, error) {
+    lf, err := ioutil.TempFile(cache.dir, ".upload-")
+    if err != nil {
+        return nil, err
+    }
+    f := &fileFetcher{
+        cache:     cache,
+        localPath: lf.Name(),
+        rf:        rf,
+        lf:        lf,
+        opened:    1,
+        dirty:     true,
+        inflight:  make(map[int64]bool),
+        failed:    make(map[int64]error),
+        progress:  make(chan struct{}),
+    }
+    cache.open(f.name())
+    return f, nil
+}
+
 //
 func deleteFileFetcher(f *fileFetcher) {
+    f.Lock()
+    defer f.Unlock()
     if f.lf != nil {
         f.lf.Close()
     }
-    os.Remove(f.localPath)
+    f.removeLocal()
     f = nil
 }
 
-//
-func (f *fileFetcher) Open(r *Remote) error {
-
-    logger := log.WithFields(log.Fields{"func": "fetcher.go:Open", "file": f.localPath})
-    var err error
-    if _, err := os.Stat(f.localPath); os.IsNotExist(err) {
-        if RemoteIsDesktopFile(f.rf) {
-            err = f.makeDesktopFile()
-            if err != nil {
-                logger.Debugf("Failed to create Desktopfile %v", err)
+// Opens the local copy of the file, only the blocks being read are
+// downloaded. The whole file is downloaded once it is being changed,
+// see waitComplete.
+func (f *fileFetcher) Open(r DriveBackend) error {
+    f.Lock()
+    defer f.Unlock()
+    // Registered first so the local copy isn't evicted while opened.
+    f.cache.open(f.name())
+    if f.lf == nil {
+        if err := f.openLocal(r); err != nil {
+            log.WithFields(log.Fields{
+                "func": "fetcher.go:Open",
+                "file": f.localPath}).Warn(err)
+            f.cache.cancel(f.name())
+            return err
+        }
+    }
+    f.opened++
+    return nil
+}
+
+// Opens the local copy, a sparse one with an empty block map is made
+// when the file is not stored locally. A local copy without a block
+// map is complete. The caller holds the lock.
+func (f *fileFetcher) openLocal(r DriveBackend) error {
+    mp := blockMapPath(path.Dir(f.localPath), f.name())
+    _, err := os.Stat(f.localPath)
+    switch {
+    case err == nil:
+        if f.blocks == nil {
+            f.blocks, err = loadBlockMap(mp, f.rf.FileSize)
+            if err != nil && !os.IsNotExist(err) {
                 return err
             }
-        } else {
-            logger.Debug("File not stored locally, downloading")
-            ready := make(chan error)
-            go f.download(r, ready)
-            logger.Debug("Waiting for download to be ready")
-            err = <-ready
-            if err != nil {
-                logger.Warn(err)
+        }
+    case os.IsNotExist(err) && f.export != "":
+        if err = f.exportFile(r); err != nil {
+            return err
+        }
+    case os.IsNotExist(err) && RemoteIsDesktopFile(f.rf):
+        if err = f.makeDesktopFile(); err != nil {
+            return err
+        }
+    case os.IsNotExist(err):
+        m := newBlockMap(mp, f.rf.FileSize)
+        f.blocks = nil
+        f.broken = nil
+        f.retries = 0
+        if !m.complete() {
+            // Save the map first, a local copy without it is complete.
+            if err = m.save(); err != nil {
                 return err
             }
+            f.blocks = m
         }
-    }
-
-    if f.lf == nil {
-        f.lf, err = os.Open(f.localPath)
+        out, err := os.OpenFile(f.localPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
         if err != nil {
             return err
         }
+        err = out.Truncate(f.rf.FileSize)
+        out.Close()
+        if err != nil {
+            return err
+        }
+    default:
+        return err
     }
-    f.opened++
 
-    return nil
+    f.lf, err = os.OpenFile(f.localPath, os.O_RDWR, 0600)
+    return err
+}
+
+// Downloads the whole exported file, it is stored under a temporary
+// name first so a failed export doesn't look like a complete one.
+func (f *fileFetcher) exportFile(r DriveBackend) error {
+    in, err := r.Export(f.rf, f.export)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := ioutil.TempFile(path.Dir(f.localPath), ".export-")
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(out, in)
+    out.Close()
+    if err == nil {
+        err = os.Rename(out.Name(), f.localPath)
+    }
+    if err != nil {
+        os.Remove(out.Name())
+    }
+    return err
+}
+
+// Size of the opened local copy.
+func (f *fileFetcher) Size() int64 {
+    if f.lf == nil {
+        return 0
+    }
+    fi, err := f.lf.Stat()
+    if err != nil {
+        return 0
+    }
+    return fi.Size()
+}
+
+// Name of the local copy in the cache.
+func (f *fileFetcher) name() string {
+    return path.Base(f.localPath)
+}
+
+// Removes the local copy together with its block map. The caller
+// holds the lock.
+func (f *fileFetcher) removeLocal() {
+    f.blocks = nil
+    os.Remove(blockMapPath(path.Dir(f.localPath), f.name()))
+    os.Remove(f.localPath)
 }
 
 func (f *fileFetcher) Close() {
+    f.Lock()
+    defer f.Unlock()
+    var size int64
+    if fi, err := f.lf.Stat(); err == nil {
+        size = diskUsage(fi)
+    }
+    f.cache.close(f.name(), size)
     f.opened--
     if f.opened == 0 {
         log.WithFields(log.Fields{
@@ -95,96 +246,448 @@ func (f *fileFetcher) Close() {
             "file": f.localPath}).Debug("Closing file handle")
         f.lf.Close()
         f.lf = nil
+        if f.pending != nil {
+            f.rf = f.pending
+            f.pending = nil
+            f.removeLocal()
+        }
+    }
+}
+
+// The local copy no longer matches the remote file rf, it is removed
+// right away or when the last handle is closed if the file is opened.
+func (f *fileFetcher) invalidate(rf *drive.File) {
+    f.Lock()
+    defer f.Unlock()
+    if f.opened > 0 {
+        f.pending = rf
+        return
+    }
+    f.rf = rf
+    f.removeLocal()
+}
+
+// Waits until the blocks covering the bytes from off to end are in the
+// local copy, the missing blocks nobody is downloading yet are
+// requested. It is woken up by the downloads whenever they make
+// progress, it fails when a download of any of the blocks fails or
+// when the ctx is cancelled.
+func (f *fileFetcher) wait(ctx context.Context, r DriveBackend, off int64, end int64) error {
+    f.Lock()
+    if end > f.rf.FileSize {
+        end = f.rf.FileSize
+    }
+    if end <= off {
+        f.Unlock()
+        return nil
+    }
+    first, last := off/BlockSize, (end-1)/BlockSize
+    // A new read tries again the blocks which failed before.
+    for i := first; i <= last; i++ {
+        delete(f.failed, i)
+    }
+    f.Unlock()
+
+    for {
+        f.Lock()
+        missing, err := f.request(r, first, last)
+        progress := f.progress
+        f.Unlock()
+        if err != nil || !missing {
+            return err
+        }
+        select {
+        case <-progress:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
     }
 }
 
-func (f *fileFetcher) download(r *Remote, ready chan error) {
+// Waits until the whole file is downloaded and its checksum checked,
+// only then the local copy can be changed.
+func (f *fileFetcher) waitComplete(ctx context.Context, r DriveBackend) error {
+    for {
+        if err := f.wait(ctx, r, 0, math.MaxInt64); err != nil {
+            return err
+        }
+        f.Lock()
+        done, progress := f.blocks == nil, f.progress
+        f.Unlock()
+        if done {
+            return nil
+        }
+        select {
+        case <-progress:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// Wakes up everybody waiting for a download. The caller holds the
+// lock.
+func (f *fileFetcher) signal() {
+    close(f.progress)
+    f.progress = make(chan struct{})
+}
+
+// Starts downloads of the missing blocks from first to last and a few
+// blocks after them, it reports whether any of the blocks from first
+// to last is missing or the error of the failed download of one of
+// them. The caller holds the lock.
+func (f *fileFetcher) request(r DriveBackend, first int64, last int64) (bool, error) {
+    if f.broken != nil {
+        return true, f.broken
+    }
+    if f.blocks == nil {
+        return false, nil
+    }
+    missing := false
+    for i := first; i <= last; i++ {
+        if f.blocks.has(i) {
+            continue
+        }
+        if err := f.failed[i]; err != nil {
+            return true, err
+        }
+        missing = true
+    }
+    if !missing {
+        return false, nil
+    }
+
+    end := last + ReadAhead
+    if end >= f.blocks.count {
+        end = f.blocks.count - 1
+    }
+    for i := first; i <= end; i++ {
+        if !f.wanted(i) {
+            continue
+        }
+        j := i
+        for j < end && f.wanted(j+1) {
+            j++
+        }
+        out, err := os.OpenFile(f.localPath, os.O_WRONLY, 0600)
+        if err != nil {
+            return true, err
+        }
+        for k := i; k <= j; k++ {
+            f.inflight[k] = true
+        }
+        go f.download(r, f.rf, f.blocks, out, i, j)
+        i = j
+    }
+    return true, nil
+}
 
+// The block is missing and nobody is downloading it. The caller holds
+// the lock.
+func (f *fileFetcher) wanted(i int64) bool {
+    return !f.blocks.has(i) && !f.inflight[i] && f.failed[i] == nil
+}
+
+// Downloads the blocks from first to last of the remote file rf into
+// out, the blocks are marked in the block map m as they are written.
+func (f *fileFetcher) download(r DriveBackend, rf *drive.File, m *blockMap,
+    out *os.File, first int64, last int64) {
+
+    defer out.Close()
     logger := log.WithFields(log.Fields{
         "func":        "fetcher.go:download",
         "file":        f.localPath,
-        "remote_file": f.rf.Id})
+        "remote_file": rf.Id,
+        "first":       first,
+        "last":        last})
 
-    logger.Debug("Downloading remote file.")
-    resp, err := r.Download(f.rf)
-    if err != nil {
-        logger.Warn(err)
-        ready <- err
-        return
+    off := first * BlockSize
+    end := (last + 1) * BlockSize
+    if end > rf.FileSize {
+        end = rf.FileSize
+    }
+    logger.Debug("Downloading blocks.")
+    next := first
+    resp, err := r.Download(rf, off, end-off)
+    if err == nil {
+        defer resp.Close()
+        buf := make([]byte, BlockSize)
+        for ; next <= last; next++ {
+            n := BlockSize
+            if next == last {
+                n = int(end - next*BlockSize)
+            }
+            if _, err = io.ReadFull(resp, buf[:n]); err != nil {
+                break
+            }
+            if _, err = out.WriteAt(buf[:n], next*BlockSize); err != nil {
+                break
+            }
+            f.Lock()
+            // The map is replaced when the local copy is dropped.
+            if f.blocks == m {
+                m.set(next)
+            }
+            delete(f.inflight, next)
+            f.signal()
+            f.Unlock()
+        }
     }
-    out, err := os.OpenFile(f.localPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
     if err != nil {
         logger.Warn(err)
-        ready <- err
-        return
     }
+    logger.Debugf("Downloaded %d blocks", next-first)
 
-    defer out.Close()
-    hasher := md5.New()
-    pw, ch := progressio.NewProgressWriter(out, f.rf.FileSize)
-    defer pw.Close()
-
-    go func() {
-        sent := false
-        for p := range ch {
-            if p.Transferred > MinDownloadSize {
-                ready <- nil
-                sent = true
-            }
+    f.Lock()
+    for i := next; i <= last; i++ {
+        delete(f.inflight, i)
+        f.failed[i] = err
+    }
+    // The last download checks the checksum, the file is complete
+    // only once it matches.
+    complete := f.blocks == m && m.complete() && f.verifying != m
+    if complete {
+        f.verifying = m
+    } else if f.blocks == m {
+        if err := m.save(); err != nil {
+            logger.Warn(err)
         }
-        if !sent {
-            ready <- nil
+    }
+    f.signal()
+    f.Unlock()
+
+    if complete {
+        f.verify(rf, m)
+    }
+}
+
+// Checks the local copy with all the blocks of the map m against the
+// checksum of the remote file rf, the map is dropped when it matches
+// and the local copy is complete. On a mismatch the content is dropped
+// and the blocks are downloaded again as they are read, after
+// ChecksumRetries attempts the local copy is removed and reading the
+// file fails. A changed local copy is always kept.
+func (f *fileFetcher) verify(rf *drive.File, m *blockMap) {
+    logger := log.WithFields(log.Fields{
+        "func":        "fetcher.go:verify",
+        "file":        f.localPath,
+        "remote_file": rf.Id})
+    chksum := rf.Md5Checksum
+    if rf.Md5Checksum != "" {
+        sum, err := fileMd5(f.localPath)
+        if err == nil {
+            chksum = sum
+        } else {
+            // Can't tell, the copy is taken as it is.
+            logger.Warn(err)
         }
-    }()
+    }
 
-    w := io.MultiWriter(pw, hasher)
-    n, err := io.Copy(w, resp)
-    logger.Debugf("Downloaded %d bytes", n)
-    if err != nil {
-        logger.Warn(err)
+    f.Lock()
+    defer f.Unlock()
+    if f.verifying == m {
+        f.verifying = nil
+    }
+    if f.blocks != m {
+        // The local copy was replaced in the meantime.
         return
     }
+    if strings.EqualFold(chksum, rf.Md5Checksum) || f.dirty {
+        f.blocks = nil
+        os.Remove(m.path)
+        f.retries = 0
+        f.signal()
+        return
+    }
+    logger.WithFields(log.Fields{
+        "got":        chksum,
+        "expected":   rf.Md5Checksum,
+        "mismatches": atomic.AddUint64(&f.cache.mismatches, 1),
+    }).Warn("Checksums don't match")
 
-    chksum := fmt.Sprintf("%s", string(hasher.Sum(nil)))
-    if strings.EqualFold(chksum, f.rf.Md5Checksum) {
-        logger.WithFields(log.Fields{
-            "got":      chksum,
-            "expected": f.rf.Md5Checksum}).Warn("Checksums don't match")
-        //FIXME : delete the local file
+    f.retries++
+    if f.retries > ChecksumRetries {
+        logger.Error("Giving up, the file can't be downloaded")
+        f.broken = ErrChecksum
+        os.Remove(f.localPath)
+        f.signal()
+        return
     }
-}
 
-func (f *fileFetcher) locFileSize() int64 {
+    // Drop the content keeping the file, it might be opened.
+    m = newBlockMap(m.path, rf.FileSize)
+    err := m.save()
+    if err == nil {
+        if err = os.Truncate(f.localPath, 0); err == nil {
+            err = os.Truncate(f.localPath, rf.FileSize)
+        }
+    }
+    if err != nil {
+        logger.Error(err)
+        f.broken = err
+    } else {
+        f.blocks = m
+    }
+    f.signal()
+}
 
-    fi, err := os.Stat(f.localPath)
+// The hex md5 checksum of the content of the file.
+func fileMd5(name string) (string, error) {
+    in, err := os.Open(name)
     if err != nil {
-        log.WithFields(log.Fields{
-            "func": "fetcher.go:locFileSIze",
-            "file": f.localPath}).Warn(err)
-        return 0
+        return "", err
     }
-    return fi.Size()
+    defer in.Close()
+    hasher := md5.New()
+    if _, err := io.Copy(hasher, in); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-//
-func (f *fileFetcher) Read(off int64, b []byte) (int, error) {
+// Reads from the local copy at off, the missing blocks are downloaded
+// first. It returns less than len(b) bytes only at the end of the file.
+func (f *fileFetcher) Read(ctx context.Context, r DriveBackend, off int64, b []byte) (int, error) {
+
+    if f.lf == nil {
+        return 0, errors.New(fmt.Sprintf("File %s not opened", f.localPath))
+    }
+
+    f.cache.touch(f.name())
+    if err := f.wait(ctx, r, off, off+int64(len(b))); err != nil {
+        return 0, err
+    }
+
+    n, err := f.lf.ReadAt(b, off)
+    if err == io.EOF {
+        err = nil
+    }
+    return n, err
+}
 
+//
+func (f *fileFetcher) Write(off int64, b []byte) (int, error) {
     if f.lf == nil {
         return 0, errors.New(fmt.Sprintf("File %s not opened", f.localPath))
     }
+    f.Lock()
+    f.dirty = true
+    f.Unlock()
+    return f.lf.WriteAt(b, off)
+}
 
-    size := int64(len(b))
-    cur := f.locFileSize()
-    for cur < off+size && cur < f.rf.FileSize {
-        time.Sleep(500 * time.Millisecond)
-        cur = f.locFileSize()
+//
+func (f *fileFetcher) Truncate(size int64) error {
+    if f.lf == nil {
+        return errors.New(fmt.Sprintf("File %s not opened", f.localPath))
+    }
+    f.Lock()
+    if f.blocks != nil {
+        // Only truncating to zero gets here, nothing to download.
+        os.Remove(f.blocks.path)
+        f.blocks = nil
     }
+    f.dirty = true
+    f.Unlock()
+    return f.lf.Truncate(size)
+}
 
-    _, err := f.lf.Seek(off, os.SEEK_SET)
+// Uploads the local copy if it was changed, it returns the new remote
+// file or nil when there was nothing to upload. Existing files are
+// uploaded as a new revision unless the content on the drive changed
+// since the local copy was made, the local changes are then moved
+// aside and ErrConflict is returned.
+func (f *fileFetcher) Upload(r DriveBackend) (*drive.File, error) {
+    if !f.dirty {
+        return nil, nil
+    }
+    logger := log.WithFields(log.Fields{
+        "func": "fetcher.go:Upload",
+        "file": f.localPath})
+
+    fi, err := f.lf.Stat()
     if err != nil {
-        return 0, err
+        return nil, err
+    }
+    logger.Debugf("Uploading %d bytes", fi.Size())
+    content := io.NewSectionReader(f.lf, 0, fi.Size())
+
+    var rf *drive.File
+    if f.rf.Id == "" {
+        meta := &drive.File{Title: f.rf.Title, Parents: f.rf.Parents}
+        rf, err = r.Upload(meta, content)
+    } else {
+        var cur *drive.File
+        cur, err = r.GetFileInfo(f.rf.Id)
+        if err != nil {
+            return nil, err
+        }
+        if cur.Md5Checksum != f.rf.Md5Checksum {
+            f.keepConflict(cur)
+            return nil, ErrConflict
+        }
+        rf, err = r.Update(cur, content)
     }
-    return f.lf.Read(b)
+    if err != nil {
+        return nil, err
+    }
+
+    // The staging file becomes the local copy of the new remote file.
+    lp := path.Join(path.Dir(f.localPath), rf.Id)
+    if lp != f.localPath {
+        if err := os.Rename(f.localPath, lp); err != nil {
+            logger.Warn(err)
+        } else {
+            f.cache.rename(f.name(), rf.Id)
+            f.localPath = lp
+        }
+    }
+    f.Lock()
+    f.rf = rf
+    f.dirty = false
+    f.Unlock()
+    return rf, nil
+}
+
+// Moves the local changes aside so they don't get lost, the local copy
+// is fetched again from the drive once the file is closed.
+func (f *fileFetcher) keepConflict(cur *drive.File) {
+    logger := log.WithFields(log.Fields{
+        "func":     "fetcher.go:keepConflict",
+        "file":     f.localPath,
+        "got":      cur.Md5Checksum,
+        "expected": f.rf.Md5Checksum})
+    if cp, err := f.keepChanges(cur); err != nil {
+        logger.Error(err)
+    } else {
+        logger.Warnf("File changed on the drive, local changes kept in %s", cp)
+    }
+}
+
+// Moves the changed local copy aside to a conflict copy and returns
+// its path, the local copy is fetched again as cur once the file is
+// closed. Nothing is kept when there are no changes.
+func (f *fileFetcher) keepChanges(cur *drive.File) (string, error) {
+    f.Lock()
+    defer f.Unlock()
+    if !f.dirty {
+        return "", nil
+    }
+    cp := path.Join(path.Dir(f.localPath), fmt.Sprintf("%s%s-%d", conflictPrefix,
+        strings.TrimPrefix(f.name(), "."), time.Now().Unix()))
+    if err := os.Rename(f.localPath, cp); err != nil {
+        return "", err
+    }
+    f.dirty = false
+    f.pending = cur
+    return cp, nil
+}
+
+// Drops the local changes, they are neither uploaded nor kept.
+func (f *fileFetcher) discard() {
+    f.Lock()
+    defer f.Unlock()
+    f.dirty = false
 }
 
 //
@@ -205,6 +708,40 @@ func DesktopFileContent(f *drive.File) string {
         strings.Replace(f.MimeType, "/", "-", -1), f.Title, f.AlternateLink)
 }
 
+// Number of the handles the file is opened with, the hold is not one.
+func (f *fileFetcher) handles() int {
+    f.Lock()
+    defer f.Unlock()
+    if f.held {
+        return f.opened - 1
+    }
+    return f.opened
+}
+
+// Keeps the local copy opened when the last handle is closed, the
+// changes which are not uploaded yet are neither evicted nor dropped.
+func (f *fileFetcher) hold() {
+    f.Lock()
+    defer f.Unlock()
+    if f.held {
+        return
+    }
+    f.held = true
+    f.opened++
+    f.cache.open(f.name())
+}
+
+// Closes the local copy kept opened by hold.
+func (f *fileFetcher) unhold() {
+    f.Lock()
+    held := f.held
+    f.held = false
+    f.Unlock()
+    if held {
+        f.Close()
+    }
+}
+
 //
 func (f *fileFetcher) IsOpen() bool {
     return f.lf != nil
@@ -0,0 +1,121 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "bytes"
+    "golang.org/x/net/context"
+    "math/rand"
+    "os"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// Fetcher of a new file with size bytes of random content on the fake
+// drive, opened for reading.
+func makeTestFetcher(t *testing.T, d *FakeDrive, r *Remote, c *Config,
+    size int) (*fileFetcher, []byte) {
+    content := make([]byte, size)
+    rand.Read(content)
+    f := d.AddFile(memRootId, "file", content)
+    rf, err := r.GetFileInfo(f.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cache := MakeFileCache(c.DataDir, time.Hour, 0)
+    ff := MakeFileFetcher(cache, rf)
+    if err := ff.Open(r); err != nil {
+        t.Fatal(err)
+    }
+    return ff, content
+}
+
+func TestDownloadCutBody(t *testing.T) {
+    d := MakeFakeDrive()
+    r, c, done := makeTestRemote(t, d)
+    defer done()
+    ff, content := makeTestFetcher(t, d, r, c, 3*BlockSize)
+    defer ff.Close()
+    ctx := context.Background()
+
+    d.CutBodies(BlockSize + 100)
+    b := make([]byte, len(content))
+    if _, err := ff.Read(ctx, r, 0, b); err == nil {
+        t.Fatal("Read of the cut body succeeded")
+    }
+    ff.Lock()
+    if !ff.blocks.has(0) || ff.blocks.has(1) {
+        t.Error("Only the first block should be downloaded")
+    }
+    ff.Unlock()
+
+    // The failed blocks are downloaded again by the next read.
+    d.CutBodies(0)
+    n, err := ff.Read(ctx, r, 0, b)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n != len(content) || !bytes.Equal(b, content) {
+        t.Fatal("Read content doesn't match")
+    }
+    if err := ff.waitComplete(ctx, r); err != nil {
+        t.Fatal(err)
+    }
+    if ff.blocks != nil {
+        t.Error("Complete file still has a block map")
+    }
+}
+
+func TestDownloadSlowBody(t *testing.T) {
+    d := MakeFakeDrive()
+    r, c, done := makeTestRemote(t, d)
+    defer done()
+    ff, content := makeTestFetcher(t, d, r, c, 2*BlockSize)
+    defer ff.Close()
+
+    d.SlowBodies(time.Millisecond)
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    b := make([]byte, len(content))
+    if _, err := ff.Read(ctx, r, 0, b); err != context.DeadlineExceeded {
+        t.Fatalf("Got %v, expected the read to time out", err)
+    }
+
+    // The download goes on, a read without a deadline gets the content.
+    d.SlowBodies(0)
+    n, err := ff.Read(context.Background(), r, 0, b)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n != len(content) || !bytes.Equal(b, content) {
+        t.Fatal("Read content doesn't match")
+    }
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+    d := MakeFakeDrive()
+    r, c, done := makeTestRemote(t, d)
+    defer done()
+    ff, content := makeTestFetcher(t, d, r, c, BlockSize)
+    defer ff.Close()
+    ctx := context.Background()
+
+    // The file changes on the drive after its metadata was fetched.
+    changed := append([]byte(nil), content...)
+    changed[0]++
+    if _, err := d.Update(ff.rf, bytes.NewReader(changed)); err != nil {
+        t.Fatal(err)
+    }
+    if err := ff.waitComplete(ctx, r); err != ErrChecksum {
+        t.Fatalf("Got %v, expected %v", err, ErrChecksum)
+    }
+    if _, err := os.Stat(ff.localPath); !os.IsNotExist(err) {
+        t.Error("Broken local copy is kept")
+    }
+    if n := atomic.LoadUint64(&ff.cache.mismatches); n != ChecksumRetries+1 {
+        t.Errorf("Counted %d mismatches, expected %d", n, ChecksumRetries+1)
+    }
+}
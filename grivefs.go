@@ -10,35 +10,53 @@ import (
     "bazil.org/fuse"
     "bazil.org/fuse/fs"
     "errors"
+    "fmt"
     log "github.com/Sirupsen/logrus"
     "golang.org/x/net/context"
     drive "google.golang.org/api/drive/v2"
-    "io/ioutil"
     "os"
-    "path"
+    "strings"
     "sync"
     "sync/atomic"
+    "syscall"
     "time"
 )
 
 const (
     BSize     = 512
     SmallFile = 65536
+    // How often the uploads which failed are tried again.
+    UploadRetry = time.Minute
 )
 
 type grvNode struct {
     sync.RWMutex
     attr fuse.Attr
 
-    name   string
-    fs     *griveFS
-    rf     *drive.File
-    parent *grvDir
+    name string
+    fs   *griveFS
+    rf   *drive.File
+    // Directories the node is in, a file in more directories is
+    // linked from all of them. Directories have just one.
+    parents []*grvDir
+    gone    bool
 }
 
 type grvDir struct {
     grvNode
     nodes map[string]fs.Node
+    // Names of the nodes in this directory.
+    names map[fs.Node]string
+    // Nodes by the name their title gives and the file they had when
+    // added, the duplicates of a title are found here.
+    titled  map[string]map[fs.Node]*drive.File
+    titles  map[fs.Node]string
+    loaded  time.Time
+    loading sync.Mutex
+    // Lists the virtual directories and tells which changed files
+    // belong to them, nil for the directories on the drive.
+    lister func() ([]*drive.File, error)
+    filter func(*drive.File) bool
 }
 
 type grvFile struct {
@@ -50,106 +68,275 @@ type griveFS struct {
     c         *Config
     Uid       uint32
     Gid       uint32
-    remote    *Remote
+    remote    DriveBackend
+    cache     *fileCache
     nodeCount uint64
-    nodeId    uint64
     size      uint64
     files     uint32
     dirs      uint32
     root      *grvDir
+    virtual   []*grvDir
     done      chan int
+    idsLock   sync.Mutex
+    nodesLock sync.Mutex
+    ids       map[string][]fs.Node
+    changeTok string
+    meta      *metaStore
+    codec     *nameCodec
+    // Files with the changes which failed to upload.
+    unsaved     map[*grvFile]bool
+    unsavedLock sync.Mutex
 }
 
-func MakeGriveFS(c *Config, uid uint32, gid uint32) (*griveFS, error) {
+// Creates the file system serving the drive r.
+func MakeGriveFS(c *Config, r DriveBackend, uid uint32, gid uint32) (*griveFS, error) {
     logger := log.WithField("func", "grivefs.go:MakeGriveFS")
-    logger.Info("Connecting ....")
-    r, err := MakeRemote(c)
-    if err != nil {
-        return nil, err
+    ttl := time.Duration(c.CacheTTL) * time.Hour
+    g := &griveFS{
+        c:       c,
+        Uid:     uid,
+        Gid:     gid,
+        remote:  r,
+        cache:   MakeFileCache(c.DataDir, ttl, c.CacheMaxSize),
+        done:    make(chan int),
+        ids:     make(map[string][]fs.Node),
+        meta:    loadMetaStore(metaPath(c)),
+        unsaved: make(map[*grvFile]bool),
     }
-    g := &griveFS{c, uid, gid, r, 0, 0, 0, 0, 0, nil, make(chan int, 0)}
+    g.codec = makeNameCodec(c.NameRules)
 
-    f, err := r.GetRootFile()
-    if err != nil {
-        return nil, err
+    f := g.meta.root()
+    if g.c.ChangePollT > 0 && g.meta.token() != "" && f != nil {
+        // The stored tree is brought up to date by the changes feed.
+        logger.Info("Using stored metadata")
+        g.changeTok = g.meta.token()
+    } else {
+        // Without the changes feed the stored listings could be
+        // outdated.
+        g.meta.reset()
+        var err error
+        if f, err = g.rootFile(); err != nil {
+            return nil, err
+        }
+        // Get the token before walking the tree so that nothing
+        // changed during the walk gets lost.
+        if g.c.ChangePollT > 0 {
+            g.changeTok, err = r.StartPageToken()
+            if err != nil {
+                return nil, err
+            }
+        }
+        g.meta.setToken(g.changeTok)
+        g.meta.setRoot(f)
     }
-    logger.Info("Loading structure ...")
-    g.root = g.newDir(f, nil)
+    g.root = g.newDir(f, rootInode)
     if g.root == nil {
         return nil, errors.New("Could Not create root directory")
     }
-    logger.Info("... loaded")
+    // The virtual directories are in the root of My Drive only.
+    myDrive := c.Drive == "" && c.Root == ""
+    if c.SharedDir != "" && myDrive {
+        g.root.addfile(g.newVirtualDir(c.SharedDir, r.ListShared, isShared))
+    }
+    if c.DrivesDir != "" && myDrive {
+        g.root.addfile(g.newVirtualDir(c.DrivesDir, r.ListDrives, isDriveRoot))
+    }
     ticker := time.NewTicker(time.Duration(g.c.CacheCleanT) * time.Second)
+    retry := time.NewTicker(UploadRetry)
     go func() {
         logger.Info("Cache cleaner started")
         for {
             select {
             case <-ticker.C:
-                go g.cleanCache()
+                go g.cache.clean()
+            case <-retry.C:
+                g.retryUploads()
             case <-g.done:
                 ticker.Stop()
+                retry.Stop()
                 logger.Info("Cache cleaner stopped")
                 return
             }
         }
     }()
+    if g.c.ChangePollT > 0 {
+        go g.pollChanges()
+    }
     return g, nil
 }
 
+// The folder mounted as the root, the root of My Drive or of the shared
+// drive picked by name or id. When a root folder is set it is taken by
+// id, or by path when it starts with a slash.
+func (g *griveFS) rootFile() (*drive.File, error) {
+    f, err := g.driveRoot()
+    if err != nil || g.c.Root == "" {
+        return f, err
+    }
+    if strings.HasPrefix(g.c.Root, "/") {
+        return g.findPath(f, g.c.Root)
+    }
+    if f, err = g.remote.GetFileInfo(g.c.Root); err != nil {
+        return nil, err
+    }
+    if !RemoteIsDir(f) || RemoteIsHidden(f) {
+        return nil, fmt.Errorf("%s is not a folder", g.c.Root)
+    }
+    return f, nil
+}
+
 //
-func (g *griveFS) cleanCache() {
-    logger := log.WithFields(log.Fields{
-        "func": "grivefs.go:cleanCache",
-        "dir":  g.c.DataDir})
-    logger.Debug("Cleaning cache...")
-    fs, err := ioutil.ReadDir(g.c.DataDir)
+func (g *griveFS) driveRoot() (*drive.File, error) {
+    if g.c.Drive == "" {
+        return g.remote.GetRootFile()
+    }
+    drives, err := g.remote.ListDrives()
     if err != nil {
-        logger.Error(err)
-        return
+        return nil, err
+    }
+    for _, f := range drives {
+        if f.Id == g.c.Drive || f.Title == g.c.Drive {
+            return f, nil
+        }
     }
-    for _, fi := range fs {
-        if fi.Name()[0] == '.' {
+    return nil, fmt.Errorf("No shared drive %s", g.c.Drive)
+}
+
+// Walks the path from the folder dir, the path is made of the names
+// the folders have in the mount. Of more folders with the same title
+// the one shown under the title is taken.
+func (g *griveFS) findPath(dir *drive.File, p string) (*drive.File, error) {
+    for _, name := range strings.Split(p, "/") {
+        if name == "" {
             continue
         }
-        atm := atime(fi)
-        if !fi.IsDir() && int(time.Since(atm).Hours()) > g.c.CacheTTL {
-            logger.WithField("file", fi.Name()).Debug("Removing old file")
-            err := os.Remove(path.Join(g.c.DataDir, fi.Name()))
-            if err != nil {
-                logger.WithField("file", fi.Name()).Warn(err)
+        files, err := g.remote.ListDir(dir)
+        if err != nil {
+            return nil, err
+        }
+        title := g.decodeName(name)
+        var next *drive.File
+        for _, f := range files {
+            if f.Title == title && RemoteIsDir(f) && !RemoteIsHidden(f) &&
+                (next == nil || precedes(f, next)) {
+                next = f
             }
         }
+        if next == nil {
+            return nil, fmt.Errorf("No folder %s in %s", name, p)
+        }
+        dir = next
     }
-    logger.Debug("Cleaning cache done.")
+    return dir, nil
 }
 
 //
 func (g *griveFS) Destroy() {
     log.Info("Unmount ... shuting down")
-    g.done <- 1
+    close(g.done)
+    g.retryUploads()
+    if err := g.meta.save(); err != nil {
+        log.Warn(err)
+    }
+    if n := atomic.LoadUint64(&g.cache.mismatches); n > 0 {
+        log.Warnf("%d downloaded files didn't match their checksum", n)
+    }
     log.Info("Unmount ... done")
 }
 
-func (g *griveFS) nextId() uint64 {
-    return atomic.AddUint64(&g.nodeId, 1)
+// Remembers the node as one of the nodes representing the drive file
+// so the changes of the file can be applied to it.
+func (g *griveFS) register(id string, n fs.Node) {
+    if id == "" {
+        // Not uploaded yet.
+        return
+    }
+    g.idsLock.Lock()
+    defer g.idsLock.Unlock()
+    g.ids[id] = append(g.ids[id], n)
 }
 
-func (g *griveFS) newDir(f *drive.File, p *grvDir) *grvDir {
-    logger := log.WithFields(log.Fields{
-        "func": "grivefs.go:newDir",
-        "dir":  f.Title})
-    if p != nil {
-        logger.Debugf("Creating new directory, parent %s", p.name)
+//
+func (g *griveFS) unregister(id string, n fs.Node) {
+    g.idsLock.Lock()
+    defer g.idsLock.Unlock()
+    ns := g.ids[id]
+    for i, x := range ns {
+        if x == n {
+            ns = append(ns[:i], ns[i+1:]...)
+            break
+        }
+    }
+    if len(ns) == 0 {
+        delete(g.ids, id)
     } else {
-        logger.Debug("Creating root directory")
+        g.ids[id] = ns
     }
+}
+
+// All the nodes representing the drive file, there is one for each
+// parent directory.
+func (g *griveFS) nodesOf(id string) []fs.Node {
+    g.idsLock.Lock()
+    defer g.idsLock.Unlock()
+    ns := make([]fs.Node, len(g.ids[id]))
+    copy(ns, g.ids[id])
+    return ns
+}
+
+// Removes the node and everything below it from the id index and
+// drops the cached content of the files.
+func (g *griveFS) forget(n fs.Node) {
+    switch n := n.(type) {
+    case *grvDir:
+        n.Lock()
+        n.gone = true
+        nodes := make([]fs.Node, 0, len(n.nodes))
+        for _, c := range n.nodes {
+            nodes = append(nodes, c)
+        }
+        n.Unlock()
+        for _, c := range nodes {
+            g.unlink(c, n)
+        }
+        g.unregister(n.rf.Id, n)
+    case *grvFile:
+        n.Lock()
+        n.gone = true
+        n.fetcher.invalidate(n.rf)
+        n.Unlock()
+        g.unregister(n.rf.Id, n)
+    }
+}
+
+// The node of the drive file, a file in more directories is one node
+// linked from all of them. Directories get a node for each parent.
+func (g *griveFS) nodeFor(f *drive.File) fs.Node {
+    if RemoteIsDir(f) {
+        return g.newDir(f, g.meta.inode(f.Id))
+    }
+    g.nodesLock.Lock()
+    defer g.nodesLock.Unlock()
+    for _, n := range g.nodesOf(f.Id) {
+        if fn, ok := n.(*grvFile); ok {
+            return fn
+        }
+    }
+    return g.newFile(f)
+}
+
+// Creates the node of the directory with the given inode.
+func (g *griveFS) newDir(f *drive.File, ino uint64) *grvDir {
+    log.WithFields(log.Fields{
+        "func": "grivefs.go:newDir",
+        "dir":  f.Title}).Debug("Creating new directory")
 
     ctime, mtime, atime := fileTimes(f)
 
     dir := &grvDir{
         grvNode: grvNode{
             attr: fuse.Attr{
-                Inode:  g.nextId(),
+                Inode:  ino,
                 Size:   BSize,
                 Blocks: 1,
                 Atime:  atime,
@@ -160,35 +347,32 @@ func (g *griveFS) newDir(f *drive.File, p *grvDir) *grvDir {
                 Uid:    g.Uid,
                 Gid:    g.Gid,
             },
-            name:   f.Title,
-            fs:     g,
-            rf:     f,
-            parent: p,
+            name: g.nodeName(f),
+            fs:   g,
+            rf:   f,
         },
-        nodes: make(map[string]fs.Node),
-    }
-    g.dirs++
-
-    err := dir.loadDirContent()
-    if err != nil {
-        logger.Error(err)
+        nodes:  make(map[string]fs.Node),
+        names:  make(map[fs.Node]string),
+        titled: make(map[string]map[fs.Node]*drive.File),
+        titles: make(map[fs.Node]string),
     }
+    atomic.AddUint32(&g.dirs, 1)
+    g.register(f.Id, dir)
 
     return dir
 }
 
-func (g *griveFS) newFile(f *drive.File, p *grvDir) *grvFile {
+func (g *griveFS) newFile(f *drive.File) *grvFile {
     log.WithFields(log.Fields{
         "func": "grivefs.go:newFile",
-        "dir":  p.name,
         "file": f.Title}).Debug("Creating new file")
     ctime, mtime, atime := fileTimes(f)
 
-    g.files++
+    atomic.AddUint32(&g.files, 1)
     gf := &grvFile{
         grvNode: grvNode{
             attr: fuse.Attr{
-                Inode:  g.nextId(),
+                Inode:  g.meta.inode(f.Id),
                 Size:   uint64(f.FileSize),
                 Blocks: uint64(f.FileSize) / BSize,
                 Atime:  atime,
@@ -199,22 +383,44 @@ func (g *griveFS) newFile(f *drive.File, p *grvDir) *grvFile {
                 Uid:    g.Uid,
                 Gid:    g.Gid,
             },
-            name:   f.Title,
-            fs:     g,
-            rf:     f,
-            parent: p,
+            name: g.nodeName(f),
+            fs:   g,
+            rf:   f,
         },
-        fetcher: MakeFileFetcher(g.c.DataDir, f),
+        fetcher: MakeFileFetcher(g.cache, f),
     }
 
-    if RemoteIsDesktopFile(gf.rf) {
+    if mime, ext := g.exportFormat(f); mime != "" {
+        // The size is not known until the file is exported.
+        gf.fetcher.exportAs(mime, ext)
+    } else if RemoteIsDesktopFile(gf.rf) {
         gf.attr.Size = uint64(len(DesktopFileContent(gf.rf)))
         gf.attr.Blocks = gf.attr.Size / BSize
     }
+    g.register(f.Id, gf)
 
     return gf
 }
 
+// Creates a file which exists only locally until it is uploaded.
+func (g *griveFS) newLocalFile(name string, p *grvDir) (*grvFile, error) {
+    now := time.Now().UTC().Format(time.RFC3339)
+    rf := &drive.File{
+        Title:        g.decodeName(name),
+        CreatedDate:  now,
+        ModifiedDate: now,
+        Labels:       &drive.FileLabels{},
+        Parents:      []*drive.ParentReference{{Id: p.rf.Id}},
+    }
+    fetcher, err := MakeStagingFetcher(g.cache, rf)
+    if err != nil {
+        return nil, err
+    }
+    f := g.newFile(rf)
+    f.fetcher = fetcher
+    return f, nil
+}
+
 func (g *griveFS) Statfs(ctx context.Context, req *fuse.StatfsRequest,
     resp *fuse.StatfsResponse) error {
     log.WithField("func", "grivefs.go:Statfs").Debug("Statfs")
@@ -234,36 +440,126 @@ func (n *grvNode) Attr(o *fuse.Attr) {
     n.RUnlock()
 }
 
+// Lists the directory if it was not listed yet or the listing is
+// older than DirTTL. A stale listing is kept when the drive can't be
+// reached, the error is returned only when there is nothing to show.
+func (d *grvDir) load() error {
+    if d.isFresh() {
+        return nil
+    }
+    d.loading.Lock()
+    defer d.loading.Unlock()
+    // Somebody else might have loaded it in the meantime.
+    if d.isFresh() {
+        return nil
+    }
+    if !d.isLoaded() && d.loadStored() {
+        return nil
+    }
+
+    err := d.loadDirContent()
+    if err != nil {
+        log.WithFields(log.Fields{
+            "func": "grivefs.go:load",
+            "dir":  d.name}).Warn(err)
+        if d.isLoaded() {
+            return nil
+        }
+    }
+    return err
+}
+
+//
+func (d *grvDir) isLoaded() bool {
+    d.RLock()
+    defer d.RUnlock()
+    return !d.loaded.IsZero()
+}
+
+//
+func (d *grvDir) isFresh() bool {
+    d.RLock()
+    defer d.RUnlock()
+    if d.loaded.IsZero() {
+        return false
+    }
+    ttl := time.Duration(d.fs.c.DirTTL) * time.Second
+    return ttl <= 0 || time.Since(d.loaded) < ttl
+}
+
+// Fills the directory from the listing stored on the last mount, the
+// changes made since are applied from the changes feed.
+func (d *grvDir) loadStored() bool {
+    if d.fs.c.ChangePollT <= 0 || d.isVirtual() {
+        return false
+    }
+    files, ok := d.fs.meta.listing(d.rf.Id)
+    if !ok {
+        return false
+    }
+    for _, f := range files {
+        if !RemoteIsHidden(f) {
+            d.addfile(d.fs.nodeFor(f))
+        }
+    }
+    d.Lock()
+    d.loaded = time.Now()
+    d.Unlock()
+    return true
+}
+
+// Merges the remote listing into the nodes, the nodes already known
+// are updated so they keep their inodes and cached content.
 func (d *grvDir) loadDirContent() error {
+    files, err := d.list()
+    if err != nil {
+        return err
+    }
+    if !d.isVirtual() {
+        d.fs.meta.setListing(d.rf.Id, files)
+    }
 
-    if len(d.nodes) == 0 {
-        fs, err := d.fs.remote.ListDir(d.rf)
-        if err != nil {
-            return err
+    old := make(map[string]fs.Node)
+    d.RLock()
+    for _, n := range d.nodes {
+        // Files not uploaded yet and virtual directories are not on
+        // the remote listing.
+        if id := nodeOf(n).rf.Id; id != "" {
+            old[id] = n
         }
+    }
+    d.RUnlock()
 
-        for _, f := range fs {
-            if !(f.Labels.Trashed || f.Labels.Hidden) {
-                if RemoteIsDir(f) {
-                    d.nodes[f.Title] = d.fs.newDir(f, d)
-                    log.WithField("func", "grivefs.go:loadDirContent").
-                        Debugf("adding subdirectory: %s", f.Title)
-                } else {
-                    d.nodes[f.Title] = d.fs.newFile(f, d)
-                    log.WithField("func", "grivefs.go:loadDirContent").
-                        Debugf("adding file %s", f.Title)
-                }
-            }
+    for _, f := range files {
+        if RemoteIsHidden(f) {
+            continue
         }
+        if n, ok := old[f.Id]; ok {
+            delete(old, f.Id)
+            updateNode(n, f)
+            continue
+        }
+        d.addfile(d.fs.nodeFor(f))
+        log.WithField("func", "grivefs.go:loadDirContent").
+            Debugf("adding %s", f.Title)
+    }
+    for _, n := range old {
+        d.fs.unlink(n, d)
     }
 
+    d.Lock()
+    d.loaded = time.Now()
+    d.Unlock()
     return nil
 }
 
 func (d *grvDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-    d.RLock()
     log.WithField("func", "grivefs.go:Lookup").Debugf("Lookup %s", name)
+    if err := d.load(); err != nil {
+        return nil, fuse.EIO
+    }
 
+    d.RLock()
     n, exist := d.nodes[name]
     d.RUnlock()
 
@@ -274,15 +570,12 @@ func (d *grvDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 }
 
 func (d *grvDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-    d.RLock()
     log.WithField("func", "grivefs.go:ReadDirAll").Debugf("ReadDirAll %s", d.name)
+    if err := d.load(); err != nil {
+        return nil, fuse.EIO
+    }
 
-    // err := d.update()
-    // if err != nil {
-    //     log.Infof("GRIVEFS: Update dir %s failed %v", d.name, err)
-    //     return nil, fuse.ENOENT
-    // }
-
+    d.RLock()
     dirs := make([]fuse.Dirent, len(d.nodes)+2)
     // Add special references.
     dirs[0] = fuse.Dirent{
@@ -295,8 +588,8 @@ func (d *grvDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
         Type: fuse.DT_Dir,
     }
 
-    if d.parent != nil {
-        dirs[1].Inode = d.parent.attr.Inode
+    if len(d.parents) > 0 {
+        dirs[1].Inode = d.parents[0].attr.Inode
     } else {
         dirs[1].Inode = d.attr.Inode
     }
@@ -322,88 +615,452 @@ func (d *grvDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
     return dirs, nil
 }
 
-//
-// func (d *grvDir) update() error {
-
-//     if time.Since(d.lastRefresh).Seconds() > minRefreshDelay {
-//         log.Debug("GRIVEFS: dir update")
-//         rf, err := d.fs.remote.GetFileInfo(d.rf.Id)
-//         if err != nil {
-//             return err
-//         }
-//         ctime, mtime, atime := fileTimes(rf)
-
-//         if mtime != d.attr.Mtime {
-//             log.Debug("GRIVEFS: dir outdated, refresh")
-//             d.rf = rf
-//             d.attr.Mtime = mtime
-//             d.attr.Ctime = ctime
-//             d.attr.Crtime = ctime
-//             d.attr.Atime = atime
-//             d.attr.Size = BSize
-//             d.attr.Blocks = 1
-//             d.name = rf.Title
-//         }
-//         d.lastRefresh = time.Now()
-//     }
-//     return nil
-// }
+// Applies the new remote metadata of the directory.
+func (d *grvDir) update(rf *drive.File) {
+    ctime, mtime, atime := fileTimes(rf)
+    d.Lock()
+    d.rf = rf
+    d.attr.Mtime = mtime
+    d.attr.Ctime = ctime
+    d.attr.Crtime = ctime
+    d.attr.Atime = atime
+    d.attr.Mode = fileMode(rf)
+    d.Unlock()
+    rename(d)
+}
 
 //
 func (d *grvDir) Create(ctx context.Context, req *fuse.CreateRequest,
     resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-    return nil, nil, fuse.EPERM
+    logger := log.WithFields(log.Fields{
+        "func": "grivefs.go:Create",
+        "dir":  d.name,
+        "file": req.Name})
+    if d.isVirtual() {
+        return nil, nil, fuse.EPERM
+    }
+    if err := d.load(); err != nil {
+        return nil, nil, fuse.EIO
+    }
+
+    if !d.fs.validName(req.Name) {
+        return nil, nil, fuse.Errno(syscall.EINVAL)
+    }
+    d.RLock()
+    _, exist := d.nodes[req.Name]
+    d.RUnlock()
+    if exist {
+        return nil, nil, fuse.Errno(syscall.EEXIST)
+    }
+
+    logger.Debug("Creating file")
+    f, err := d.fs.newLocalFile(req.Name, d)
+    if err != nil {
+        logger.Warn(err)
+        return nil, nil, fuse.EIO
+    }
+    f.attr.Mode = req.Mode.Perm()
+    d.addfile(f)
+    return f, f, nil
 }
 
-//
+// Renames the title of the file and/or moves it to another directory
+// by changing its parents, an existing target of the same kind is
+// replaced.
 func (d *grvDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
-    return fuse.EPERM
+    logger := log.WithFields(log.Fields{
+        "func": "grivefs.go:Rename",
+        "dir":  d.name,
+        "old":  req.OldName,
+        "new":  req.NewName})
+    nd, ok := newDir.(*grvDir)
+    if !ok {
+        return fuse.EIO
+    }
+    if d.isVirtual() || nd.isVirtual() {
+        return fuse.EPERM
+    }
+    if !d.fs.validName(req.NewName) {
+        return fuse.Errno(syscall.EINVAL)
+    }
+    if err := d.load(); err != nil {
+        return fuse.EIO
+    }
+    if err := nd.load(); err != nil {
+        return fuse.EIO
+    }
+
+    d.RLock()
+    n, exist := d.nodes[req.OldName]
+    d.RUnlock()
+    if !exist {
+        return fuse.ENOENT
+    }
+    if isVirtual(n) {
+        return fuse.EPERM
+    }
+    nd.RLock()
+    t, exist := nd.nodes[req.NewName]
+    nd.RUnlock()
+    if exist && t != n {
+        // A file replaces only a file and a directory only a directory.
+        _, isDir := n.(*grvDir)
+        _, targetIsDir := t.(*grvDir)
+        if targetIsDir && !isDir {
+            return fuse.Errno(syscall.EISDIR)
+        }
+        if isDir && !targetIsDir {
+            return fuse.Errno(syscall.ENOTDIR)
+        }
+        if err := canRemove(t); err != nil {
+            return err
+        }
+    } else {
+        t = nil
+    }
+
+    logger.Debug("Renaming")
+    gn := nodeOf(n)
+    gn.Lock()
+    rf := gn.rf
+    title := d.fs.nodeTitle(rf, req.NewName)
+    if rf.Id == "" {
+        // Not uploaded yet, it is enough to change the metadata.
+        rf.Title = title
+        rf.Parents = []*drive.ParentReference{{Id: nd.rf.Id}}
+    }
+    gn.Unlock()
+    if rf.Id != "" {
+        var err error
+        rf, err = d.fs.remote.Move(rf, title, d.rf.Id, nd.rf.Id)
+        if err != nil {
+            logger.Warn(err)
+            return fuse.EIO
+        }
+    }
+
+    d.rmfile(n)
+    updateNode(n, rf)
+    nd.addfile(n)
+    // The replaced file goes only once the move went through, it
+    // hands its name over to the moved one. The rename is done even
+    // when it can't be removed, the other file just keeps a name with
+    // its id.
+    if t != nil {
+        if err := nd.remove(t); err != nil {
+            logger.Warnf("Can't remove the replaced file: %v", err)
+        }
+    }
+    return nil
 }
 
 //
 func (d *grvDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-    return nil, fuse.EPERM
+    logger := log.WithFields(log.Fields{
+        "func": "grivefs.go:Mkdir",
+        "dir":  d.name,
+        "name": req.Name})
+    if d.isVirtual() {
+        return nil, fuse.EPERM
+    }
+    if err := d.load(); err != nil {
+        return nil, fuse.EIO
+    }
+    if !d.fs.validName(req.Name) {
+        return nil, fuse.Errno(syscall.EINVAL)
+    }
+    d.RLock()
+    _, exist := d.nodes[req.Name]
+    d.RUnlock()
+    if exist {
+        return nil, fuse.Errno(syscall.EEXIST)
+    }
+
+    logger.Debug("Creating directory")
+    rf, err := d.fs.remote.Mkdir(d.rf, d.fs.decodeName(req.Name))
+    if err != nil {
+        logger.Warn(err)
+        return nil, fuse.EIO
+    }
+    dir := d.fs.newDir(rf, d.fs.meta.inode(rf.Id))
+    // Nothing to list in a new directory.
+    dir.loaded = time.Now()
+    d.addfile(dir)
+    return dir, nil
 }
 
 //
 func (d *grvDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-    return fuse.EPERM
+    log.WithFields(log.Fields{
+        "func": "grivefs.go:Remove",
+        "dir":  d.name,
+        "name": req.Name}).Debug("Remove")
+    if d.isVirtual() {
+        return fuse.EPERM
+    }
+    if err := d.load(); err != nil {
+        return fuse.EIO
+    }
+    d.RLock()
+    n, exist := d.nodes[req.Name]
+    d.RUnlock()
+    if !exist {
+        return fuse.ENOENT
+    }
+    if isVirtual(n) {
+        return fuse.EPERM
+    }
+    if _, isDir := n.(*grvDir); isDir != req.Dir {
+        if isDir {
+            return fuse.Errno(syscall.EISDIR)
+        }
+        return fuse.Errno(syscall.ENOTDIR)
+    }
+    return d.remove(n)
 }
 
-//
-func (d *grvDir) rmfile(f *grvFile) {
+// Removes the node from the directory and from the drive. A file with
+// more parents is only taken out of this directory, otherwise it is
+// moved to the trash or deleted depending on the configuration.
+func (d *grvDir) remove(n fs.Node) error {
+    logger := log.WithFields(log.Fields{
+        "func": "grivefs.go:remove",
+        "dir":  d.name})
+    if err := canRemove(n); err != nil {
+        return err
+    }
+
+    gn := nodeOf(n)
+    gn.RLock()
+    rf := gn.rf
+    gn.RUnlock()
+    var err error
+    switch {
+    case rf.Id == "":
+        // Not uploaded yet, nothing to do on the drive.
+    case len(rf.Parents) > 1:
+        if rf, err = d.fs.remote.Move(rf, rf.Title, d.rf.Id, ""); err == nil {
+            d.fs.unlink(n, d)
+            updateNode(n, rf)
+            return nil
+        }
+    case d.fs.c.HardDelete:
+        err = d.fs.remote.Delete(rf)
+    default:
+        err = d.fs.remote.Trash(rf)
+    }
+    if err != nil {
+        logger.Warn(err)
+        return fuse.EIO
+    }
+    if gf, ok := n.(*grvFile); ok {
+        // Removed on purpose, the changes are not worth keeping.
+        gf.fetcher.discard()
+    }
+    d.fs.removeNode(n)
+    return nil
+}
+
+// Only empty directories can be removed.
+func canRemove(n fs.Node) error {
+    sd, ok := n.(*grvDir)
+    if !ok {
+        return nil
+    }
+    if err := sd.load(); err != nil {
+        return fuse.EIO
+    }
+    sd.RLock()
+    empty := len(sd.nodes) == 0
+    sd.RUnlock()
+    if !empty {
+        return fuse.Errno(syscall.ENOTEMPTY)
+    }
+    return nil
+}
+
+// Takes the node out of the directory, the next file with the same
+// title takes over its name.
+func (d *grvDir) rmfile(n fs.Node) {
     d.Lock()
-    defer d.Unlock()
-    delete(d.nodes, f.name)
+    name, in := d.names[n]
+    if in {
+        title := d.titles[n]
+        delete(d.names, n)
+        delete(d.titles, n)
+        delete(d.titled[title], n)
+        if len(d.titled[title]) == 0 {
+            delete(d.titled, title)
+        }
+        delete(d.nodes, name)
+        var next fs.Node
+        var nrf *drive.File
+        for o, orf := range d.titled[name] {
+            if next == nil || precedes(orf, nrf) {
+                next, nrf = o, orf
+            }
+        }
+        if next != nil {
+            delete(d.nodes, d.names[next])
+            d.nodes[name] = next
+            d.names[next] = name
+        }
+    }
+    d.Unlock()
+    if in {
+        nodeOf(n).unlinked(d)
+    }
 }
 
-//
-func (d *grvDir) addfile(f *grvFile) {
+// Adds the node to the directory. When another file has the same name
+// the older one keeps it and the other gets its short id appended, so
+// the names don't depend on the order the files are listed in.
+func (d *grvDir) addfile(n fs.Node) {
+    gn := nodeOf(n)
+    gn.RLock()
+    name, rf := gn.name, gn.rf
+    gn.RUnlock()
     d.Lock()
-    defer d.Unlock()
-    d.nodes[f.name] = f
+    if _, in := d.names[n]; in {
+        d.Unlock()
+        return
+    }
+    title := name
+    if o, taken := d.nodes[name]; taken {
+        if orf, held := d.titled[name][o]; held && precedes(rf, orf) {
+            dup := d.fs.dupName(orf)
+            d.nodes[dup] = o
+            d.names[o] = dup
+        } else {
+            name = d.fs.dupName(rf)
+        }
+    }
+    d.nodes[name] = n
+    d.names[n] = name
+    if d.titled[title] == nil {
+        d.titled[title] = make(map[fs.Node]*drive.File)
+    }
+    d.titled[title][n] = rf
+    d.titles[n] = title
+    d.Unlock()
+    gn.linked(d)
+}
+
+// Moves the node to the name its title gives in all the directories
+// it is in.
+func rename(n fs.Node) {
+    gn := nodeOf(n)
+    gn.Lock()
+    rf := gn.rf
+    gn.name = gn.fs.nodeName(rf)
+    name := gn.name
+    gn.Unlock()
+    for _, p := range gn.parentDirs() {
+        p.Lock()
+        cur, o := p.names[n], p.nodes[name]
+        if title, in := p.titles[n]; in {
+            p.titled[title][n] = rf
+        }
+        p.Unlock()
+        if cur == name {
+            continue
+        }
+        if cur == p.fs.dupName(rf) && o != nil && o != n {
+            // Keep the name while an older file has the title.
+            continue
+        }
+        p.rmfile(n)
+        p.addfile(n)
+    }
+}
+
+// The directories the node is in.
+func (n *grvNode) parentDirs() []*grvDir {
+    n.RLock()
+    defer n.RUnlock()
+    ps := make([]*grvDir, len(n.parents))
+    copy(ps, n.parents)
+    return ps
+}
+
+// Remembers the node was added to the directory.
+func (n *grvNode) linked(d *grvDir) {
+    n.Lock()
+    defer n.Unlock()
+    for _, p := range n.parents {
+        if p == d {
+            return
+        }
+    }
+    n.parents = append(n.parents, d)
+    if !RemoteIsDir(n.rf) {
+        n.attr.Nlink = n.links()
+    }
+}
+
+//
+func (n *grvNode) unlinked(d *grvDir) {
+    n.Lock()
+    defer n.Unlock()
+    for i, p := range n.parents {
+        if p == d {
+            n.parents = append(n.parents[:i], n.parents[i+1:]...)
+            break
+        }
+    }
+    if !RemoteIsDir(n.rf) {
+        n.attr.Nlink = n.links()
+    }
+}
+
+// Number of links of a file, one for each of its parents on the drive
+// whether the directories were listed or not. A file shown in more
+// directories than it has parents, like the shared one, has a link in
+// each. A file removed from all the directories has no links. The
+// caller holds the lock.
+func (n *grvNode) links() uint32 {
+    links := len(n.rf.Parents)
+    if len(n.parents) == 0 {
+        links = 0
+    } else if len(n.parents) > links {
+        links = len(n.parents)
+    }
+    return uint32(links)
 }
 
 //
 func (f *grvFile) Open(ctx context.Context, req *fuse.OpenRequest,
     resp *fuse.OpenResponse) (fs.Handle, error) {
-    var err error
-    f.Lock()
-    defer f.Unlock()
+    f.RLock()
     log.WithField("func", "grivefs.go:Open").Debugf("Open %s", f.name)
-    // err = f.update()
-    // if err != nil {
-    //     return f, err
-    // }
-    err = f.fetcher.Open(f.fs.remote)
-    return f, err
+    gone, rf := f.gone, f.rf
+    f.RUnlock()
+    if gone {
+        return nil, fuse.ENOENT
+    }
+    if !req.Flags.IsReadOnly() && RemoteIsDesktopFile(rf) {
+        return nil, fuse.EPERM
+    }
+    // Exported files are downloaded here, the node is not locked so
+    // it can be used meanwhile.
+    if err := f.fetcher.Open(f.fs.remote); err != nil {
+        return nil, fetchError(ctx, err)
+    }
+    if f.fetcher.export != "" {
+        // The size was unknown until now, let the reads go past it.
+        resp.Flags |= fuse.OpenDirectIO
+        f.Lock()
+        f.attr.Size = uint64(f.fetcher.Size())
+        f.attr.Blocks = f.attr.Size / BSize
+        f.Unlock()
+    }
+    return f, nil
 }
 
 //
 func (f *grvFile) Read(ctx context.Context, req *fuse.ReadRequest,
     resp *fuse.ReadResponse) error {
     f.RLock()
-    defer f.RUnlock()
     log.WithFields(log.Fields{
         "func":       "grivefs.go:Read",
         "file":       f.name,
@@ -411,76 +1068,303 @@ func (f *grvFile) Read(ctx context.Context, req *fuse.ReadRequest,
         "off":        req.Offset,
         "size":       req.Size,
     }).Debug("Read")
+    f.RUnlock()
 
+    // The missing blocks are downloaded without holding the lock.
     resp.Data = make([]byte, req.Size)
-    _, err := f.fetcher.Read(req.Offset, resp.Data)
-    return err
+    n, err := f.fetcher.Read(ctx, f.fs.remote, req.Offset, resp.Data)
+    if err != nil {
+        return fetchError(ctx, err)
+    }
+    resp.Data = resp.Data[:n]
+    return nil
 }
 
 //
+// Flush is called on every close, the changes are uploaded when the
+// last handle is being closed.
 func (f *grvFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+    f.Lock()
+    defer f.Unlock()
     log.WithField("func", "grivefs.go:Flush").Debugf("Flush %s", f.name)
-    return nil
+    if f.fetcher.handles() > 1 {
+        return nil
+    }
+    return f.upload()
 }
 
 //
 func (f *grvFile) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-    f.RLock()
+    f.Lock()
     log.WithField("func", "grivefs.go:Release").Debugf("Release (close) %s", f.name)
-    defer f.RUnlock()
+    defer f.Unlock()
+    var err error
+    if f.fetcher.handles() == 1 {
+        // Flush failed or was not called at all, try again.
+        err = f.upload()
+    }
     f.fetcher.Close()
-    return nil
+    return err
 }
 
 //
 func (f *grvFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-    return fuse.EPERM
+    // The whole file is needed before it is changed, it is downloaded
+    // without holding the lock.
+    if err := f.fetcher.waitComplete(ctx, f.fs.remote); err != nil {
+        return fetchError(ctx, err)
+    }
+    f.Lock()
+    defer f.Unlock()
+    log.WithFields(log.Fields{
+        "func": "grivefs.go:Write",
+        "file": f.name,
+        "off":  req.Offset,
+        "size": len(req.Data),
+    }).Debug("Write")
+
+    n, err := f.fetcher.Write(req.Offset, req.Data)
+    resp.Size = n
+    if err != nil {
+        return fuse.EIO
+    }
+    if end := uint64(req.Offset) + uint64(n); end > f.attr.Size {
+        f.attr.Size = end
+        f.attr.Blocks = end / BSize
+    }
+    f.attr.Mtime = time.Now()
+    return nil
 }
 
-//
+// Only the size and the times can be set, the times are kept locally.
 func (f *grvFile) Setattr(ctx context.Context, req *fuse.SetattrRequest,
     resp *fuse.SetattrResponse) error {
-    return fuse.EPERM
+    if req.Valid.Size() {
+        if err := f.truncate(ctx, int64(req.Size)); err != nil {
+            return err
+        }
+    }
+    f.Lock()
+    defer f.Unlock()
+    if req.Valid.Atime() {
+        f.attr.Atime = req.Atime
+    }
+    if req.Valid.Mtime() {
+        f.attr.Mtime = req.Mtime
+    }
+    resp.Attr = f.attr
+    return nil
+}
+
+// Changes the size of the file, it is uploaded right away unless there
+// are other handles which upload it when closed. Only the part which is
+// kept is downloaded, without holding the lock.
+func (f *grvFile) truncate(ctx context.Context, size int64) error {
+    f.RLock()
+    logger := log.WithFields(log.Fields{
+        "func": "grivefs.go:truncate",
+        "file": f.name,
+        "size": size})
+    rf := f.rf
+    f.RUnlock()
+    if RemoteIsDesktopFile(rf) {
+        return fuse.EPERM
+    }
+    err := f.fetcher.Open(f.fs.remote)
+    if err != nil {
+        logger.Warn(err)
+        return fetchError(ctx, err)
+    }
+    if size > 0 {
+        err = f.fetcher.waitComplete(ctx, f.fs.remote)
+    }
+    f.Lock()
+    defer f.Unlock()
+    defer f.fetcher.Close()
+    if err != nil {
+        logger.Warn(err)
+        return fetchError(ctx, err)
+    }
+
+    if err = f.fetcher.Truncate(size); err != nil {
+        logger.Warn(err)
+        return fuse.EIO
+    }
+    f.attr.Size = uint64(size)
+    f.attr.Blocks = f.attr.Size / BSize
+    f.attr.Mtime = time.Now()
+    if f.fetcher.handles() == 1 {
+        return f.upload()
+    }
+    return nil
+}
+
+// Uploads the local changes, the node takes the metadata of the
+// uploaded file. When the upload fails the local copy is held opened
+// so it is not evicted and the upload is tried again later. The
+// changes of a file removed on the drive or refused by the drive for
+// good are kept in a conflict copy. The caller holds the lock.
+func (f *grvFile) upload() error {
+    if f.gone {
+        defer f.fetcher.unhold()
+        return f.keepChanges("File was removed on the drive")
+    }
+    isNew := f.rf.Id == ""
+    rf, err := f.fetcher.Upload(f.fs.remote)
+    if err == ErrConflict || isPermanent(err) {
+        // Trying again won't help, a conflict has the changes kept
+        // already.
+        defer f.fetcher.unhold()
+        if err := f.keepChanges(fmt.Sprintf("Upload refused, %v", err)); err != nil {
+            return err
+        }
+        return fuse.EIO
+    }
+    if err != nil {
+        log.WithFields(log.Fields{
+            "func": "grivefs.go:upload",
+            "file": f.name}).Warnf("Upload failed, trying again later: %v", err)
+        f.fetcher.hold()
+        f.fs.unsavedLock.Lock()
+        f.fs.unsaved[f] = true
+        f.fs.unsavedLock.Unlock()
+        return fuse.EIO
+    }
+    f.fetcher.unhold()
+    if rf == nil {
+        return nil
+    }
+    f.setAttr(rf)
+    if isNew {
+        f.fs.meta.setInode(rf.Id, f.attr.Inode)
+        f.fs.register(rf.Id, f)
+    }
+    return nil
+}
+
+// Moves the changes which can't be uploaded to a conflict copy, the
+// caller holds the lock.
+func (f *grvFile) keepChanges(reason string) error {
+    logger := log.WithFields(log.Fields{
+        "func": "grivefs.go:keepChanges",
+        "file": f.name})
+    cp, err := f.fetcher.keepChanges(f.rf)
+    if err != nil {
+        logger.Errorf("%s, local changes lost: %v", reason, err)
+        return fuse.EIO
+    }
+    if cp != "" {
+        logger.Warnf("%s, local changes kept in %s", reason, cp)
+    }
+    return nil
+}
+
+// Uploads again the files whose upload failed, those opened now are
+// uploaded when closed.
+func (g *griveFS) retryUploads() {
+    g.unsavedLock.Lock()
+    files := make([]*grvFile, 0, len(g.unsaved))
+    for f := range g.unsaved {
+        files = append(files, f)
+    }
+    g.unsaved = make(map[*grvFile]bool)
+    g.unsavedLock.Unlock()
+    for _, f := range files {
+        f.Lock()
+        if f.fetcher.handles() == 0 {
+            f.upload()
+        }
+        f.Unlock()
+    }
+}
+
+// Applies the new remote metadata of the file, the local copy is
+// dropped when the content changed.
+func (f *grvFile) update(rf *drive.File) {
+    f.Lock()
+    if contentChanged(f.rf, rf) {
+        log.WithFields(log.Fields{
+            "func": "grivefs.go:update",
+            "file": f.name}).Debug("File outdated, dropping local copy")
+        f.fetcher.invalidate(rf)
+        if f.fetcher.export != "" {
+            f.attr.Size = 0
+        }
+    }
+    f.setAttr(rf)
+    f.Unlock()
+    rename(f)
+}
+
+// Takes the attributes from the remote metadata, the caller holds the
+// lock.
+func (f *grvFile) setAttr(rf *drive.File) {
+    ctime, mtime, atime := fileTimes(rf)
+    f.rf = rf
+    f.attr.Mtime = mtime
+    f.attr.Ctime = ctime
+    f.attr.Crtime = ctime
+    f.attr.Atime = atime
+    f.attr.Mode = fileMode(rf)
+    switch {
+    case f.fetcher.export != "":
+        // Known only from the exported local copy.
+    case RemoteIsDesktopFile(rf):
+        f.attr.Size = uint64(len(DesktopFileContent(rf)))
+    default:
+        f.attr.Size = uint64(rf.FileSize)
+    }
+    f.attr.Blocks = f.attr.Size / BSize
+    f.attr.Nlink = f.links()
+}
+
+// Compares the checksums if there are any, metadata changes like a
+// rename don't make the local copy outdated.
+func contentChanged(old *drive.File, rf *drive.File) bool {
+    if old.Md5Checksum != "" && rf.Md5Checksum != "" {
+        return old.Md5Checksum != rf.Md5Checksum
+    }
+    return old.ModifiedDate != rf.ModifiedDate
 }
 
 //
-// func (f *grvFile) update() error {
-
-//     if time.Since(f.lastRefresh).Seconds() > minRefreshDelay {
-//         log.Debug("GRIVEFS: file update %s", f.name)
-//         rf, err := f.fs.remote.GetFileInfo(f.rf.Id)
-//         if err != nil {
-//             return err
-//         }
-//         // Was the file deleted?
-//         if rf.Labels.Trashed {
-//             f.parent.rmfile(f)
-//             deleteFileFetcher(f.fetcher)
-//             f = nil
-//             return fuse.ENOENT
-//         }
-
-//         ctime, mtime, atime := fileTimes(rf)
-
-//         if mtime != f.attr.Mtime {
-//             log.Debug("GRIVEFS: file outdated, refresh")
-//             deleteFileFetcher(f.fetcher)
-//             f.rf = rf
-//             f.fetcher = MakeFileFetcher(f.fs.c.DataDir, rf)
-//             f.attr.Mtime = mtime
-//             f.attr.Ctime = ctime
-//             f.attr.Crtime = ctime
-//             f.attr.Atime = atime
-//             f.attr.Size = uint64(rf.FileSize)
-//             f.attr.Blocks = uint64(rf.FileSize) / BSize
-//             f.parent.rmfile(f)
-//             f.name = rf.Title
-//             f.parent.addfile(f)
-//         }
-//         f.lastRefresh = time.Now()
-//     }
-//     return nil
-// }
+func updateNode(n fs.Node, rf *drive.File) {
+    switch n := n.(type) {
+    case *grvDir:
+        n.update(rf)
+    case *grvFile:
+        n.update(rf)
+    }
+}
+
+//
+func nodeOf(n fs.Node) *grvNode {
+    switch n := n.(type) {
+    case *grvDir:
+        return &n.grvNode
+    case *grvFile:
+        return &n.grvNode
+    }
+    return nil
+}
+
+// Error returned to the kernel when fetching the file content failed.
+func fetchError(ctx context.Context, err error) error {
+    if ctx.Err() != nil {
+        return fuse.EINTR
+    }
+    if re, ok := err.(*RemoteError); ok {
+        switch re.Kind {
+        case ErrNotFound:
+            return fuse.ENOENT
+        case ErrForbidden:
+            return fuse.Errno(syscall.EACCES)
+        case ErrRateLimited:
+            return fuse.Errno(syscall.EAGAIN)
+        }
+    }
+    return fuse.EIO
+}
 
 //
 func fileTimes(f *drive.File) (time.Time, time.Time, time.Time) {
@@ -508,12 +1392,36 @@ func fileTimes(f *drive.File) (time.Time, time.Time, time.Time) {
     return ctime, mtime, atime
 }
 
-//
+// The mime type and the extension the Google Apps file is exported as,
+// both are empty when the file is shown as a desktop file.
+func (g *griveFS) exportFormat(f *drive.File) (string, string) {
+    if !g.c.ExportDocs || !RemoteIsDesktopFile(f) {
+        return "", ""
+    }
+    ext := g.c.ExportFormats[f.MimeType]
+    mime := exportMimeTypes[ext]
+    if mime == "" || f.ExportLinks[mime] == "" {
+        return "", ""
+    }
+    return mime, ext
+}
+
+// Mode of the file, the write permission is taken away when the
+// capabilities of the user don't allow changing the file or adding
+// files to the directory.
 func fileMode(f *drive.File) os.FileMode {
-    m := os.FileMode(0440)
+    m := os.FileMode(0640)
+    c := f.Capabilities
 
     if RemoteIsDir(f) {
-        m = os.FileMode(0550) | os.ModeDir
+        m = os.FileMode(0750) | os.ModeDir
+        if c != nil && !c.CanAddChildren {
+            m &^= 0200
+        }
+    } else if RemoteIsDesktopFile(f) {
+        m = os.FileMode(0440)
+    } else if c != nil && !c.CanEdit {
+        m &^= 0200
     }
 
     return m
@@ -0,0 +1,684 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+import (
+    "bazil.org/fuse"
+    "errors"
+    "golang.org/x/net/context"
+    drive "google.golang.org/api/drive/v2"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+var errRefused = errors.New("Refused by the test")
+
+// Drive in memory which refuses the moves and the uploads with err
+// while it is set.
+type failingRemote struct {
+    *MemRemote
+    err error
+}
+
+//
+func (r *failingRemote) Upload(f *drive.File, c io.Reader) (*drive.File, error) {
+    if r.err != nil {
+        return nil, r.err
+    }
+    return r.MemRemote.Upload(f, c)
+}
+
+//
+func (r *failingRemote) Update(f *drive.File, c io.Reader) (*drive.File, error) {
+    if r.err != nil {
+        return nil, r.err
+    }
+    return r.MemRemote.Update(f, c)
+}
+
+//
+func (r *failingRemote) Move(f *drive.File, title string, from string, to string) (*drive.File, error) {
+    if r.err != nil {
+        return nil, r.err
+    }
+    return r.MemRemote.Move(f, title, from, to)
+}
+
+// File system over the drive with a fresh configuration, the changes
+// are not polled and the returned function destroys it and removes
+// the data directory.
+func makeTestFS(t *testing.T, r DriveBackend) (*griveFS, func()) {
+    dir, err := ioutil.TempDir("", "grivefs-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := newConfig(dir+"/config.json", dir)
+    c.ChangePollT = 0
+    g, err := MakeGriveFS(c, r, 0, 0)
+    if err != nil {
+        os.RemoveAll(dir)
+        t.Fatal(err)
+    }
+    return g, func() {
+        g.Destroy()
+        os.RemoveAll(dir)
+    }
+}
+
+// Sorted names in the directory without the dot entries and the
+// virtual directories.
+func dirNames(t *testing.T, d *grvDir) []string {
+    ents, err := d.ReadDirAll(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    names := []string{}
+    for _, e := range ents {
+        if e.Name == "." || e.Name == ".." {
+            continue
+        }
+        d.RLock()
+        n := d.nodes[e.Name]
+        d.RUnlock()
+        if !isVirtual(n) {
+            names = append(names, e.Name)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+//
+func checkNames(t *testing.T, d *grvDir, want ...string) {
+    // The names can't contain a slash.
+    if got := dirNames(t, d); strings.Join(got, "/") != strings.Join(want, "/") {
+        t.Fatalf("Directory %s has %v, expected %v", d.name, got, want)
+    }
+}
+
+//
+func lookupFile(t *testing.T, d *grvDir, name string) *grvFile {
+    n, err := d.Lookup(context.Background(), name)
+    if err != nil {
+        t.Fatalf("Lookup of %s: %v", name, err)
+    }
+    f, ok := n.(*grvFile)
+    if !ok {
+        t.Fatalf("%s is not a file", name)
+    }
+    return f
+}
+
+//
+func lookupDir(t *testing.T, d *grvDir, name string) *grvDir {
+    n, err := d.Lookup(context.Background(), name)
+    if err != nil {
+        t.Fatalf("Lookup of %s: %v", name, err)
+    }
+    sd, ok := n.(*grvDir)
+    if !ok {
+        t.Fatalf("%s is not a directory", name)
+    }
+    return sd
+}
+
+// Content of the file read through a new handle.
+func readFile(t *testing.T, f *grvFile) string {
+    ctx := context.Background()
+    req := &fuse.OpenRequest{Flags: fuse.OpenReadOnly}
+    if _, err := f.Open(ctx, req, &fuse.OpenResponse{}); err != nil {
+        t.Fatal(err)
+    }
+    defer f.Release(ctx, &fuse.ReleaseRequest{})
+    resp := &fuse.ReadResponse{}
+    if err := f.Read(ctx, &fuse.ReadRequest{Size: 1 << 16}, resp); err != nil {
+        t.Fatal(err)
+    }
+    return string(resp.Data)
+}
+
+//
+func checkContent(t *testing.T, m *MemRemote, id string, want string) {
+    b, err := m.Content(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(b) != want {
+        t.Errorf("Drive has %q in %s, expected %q", b, id, want)
+    }
+}
+
+// Opens the file for writing and writes the data at off, the handle
+// is left opened.
+func writeFile(t *testing.T, f *grvFile, off int64, data string) {
+    ctx := context.Background()
+    req := &fuse.OpenRequest{Flags: fuse.OpenReadWrite}
+    if _, err := f.Open(ctx, req, &fuse.OpenResponse{}); err != nil {
+        t.Fatal(err)
+    }
+    write := &fuse.WriteRequest{Offset: off, Data: []byte(data)}
+    if err := f.Write(ctx, write, &fuse.WriteResponse{}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Contents of the conflict copies in the cache.
+func conflictCopies(t *testing.T, g *griveFS) []string {
+    names, err := filepath.Glob(filepath.Join(g.cache.dir, ".conflict-*"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    copies := []string{}
+    for _, n := range names {
+        b, err := ioutil.ReadFile(n)
+        if err != nil {
+            t.Fatal(err)
+        }
+        copies = append(copies, string(b))
+    }
+    sort.Strings(copies)
+    return copies
+}
+
+//
+func checkTrashed(t *testing.T, m *MemRemote, id string, want bool) {
+    f, err := m.GetFileInfo(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if trashed := f.Labels != nil && f.Labels.Trashed; trashed != want {
+        t.Errorf("File %s trashed %v, expected %v", id, trashed, want)
+    }
+}
+
+func TestLookupReadDir(t *testing.T) {
+    m := MakeMemRemote()
+    m.AddFile(memRootId, "a.txt", []byte("hello"))
+    docs := m.AddDir(memRootId, "docs")
+    m.AddFile(docs.Id, "b.txt", []byte("world"))
+    m.AddFile(memRootId, "x/y", []byte("slash"))
+    g, done := makeTestFS(t, m)
+    defer done()
+
+    checkNames(t, g.root, "a.txt", "docs", "x∕y")
+    a := lookupFile(t, g.root, "a.txt")
+    if got := readFile(t, a); got != "hello" {
+        t.Errorf("Read %q, expected hello", got)
+    }
+    if a.attr.Crtime.IsZero() || a.attr.Mtime.IsZero() {
+        t.Errorf("File created at %v and modified at %v", a.attr.Crtime, a.attr.Mtime)
+    }
+    if got := readFile(t, lookupFile(t, g.root, "x∕y")); got != "slash" {
+        t.Errorf("Read %q, expected slash", got)
+    }
+    if _, err := g.root.Lookup(context.Background(), "missing"); err != fuse.ENOENT {
+        t.Errorf("Lookup of a missing file got %v, expected ENOENT", err)
+    }
+
+    d := lookupDir(t, g.root, "docs")
+    checkNames(t, d, "b.txt")
+    if got := readFile(t, lookupFile(t, d, "b.txt")); got != "world" {
+        t.Errorf("Read %q, expected world", got)
+    }
+    if n, _ := g.root.Lookup(context.Background(), "docs"); n != d {
+        t.Error("Lookup returned another node of the directory")
+    }
+}
+
+func TestCreateWriteFlush(t *testing.T) {
+    m := MakeMemRemote()
+    a := m.AddFile(memRootId, "a.txt", []byte("hello"))
+    g, done := makeTestFS(t, m)
+    defer done()
+    ctx := context.Background()
+
+    req := &fuse.CreateRequest{Name: "new.txt", Flags: fuse.OpenReadWrite, Mode: 0644}
+    n, _, err := g.root.Create(ctx, req, &fuse.CreateResponse{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    f := n.(*grvFile)
+    if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("abc")}, &fuse.WriteResponse{}); err != nil {
+        t.Fatal(err)
+    }
+    if err := f.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+        t.Fatal(err)
+    }
+    f.Release(ctx, &fuse.ReleaseRequest{})
+    if f.rf.Id == "" {
+        t.Fatal("Created file was not uploaded")
+    }
+    checkContent(t, m, f.rf.Id, "abc")
+    if lookupFile(t, g.root, "new.txt") != f {
+        t.Error("Lookup returned another node of the created file")
+    }
+    if _, _, err := g.root.Create(ctx, req, &fuse.CreateResponse{}); err != fuse.Errno(syscall.EEXIST) {
+        t.Errorf("Create of an existing name got %v, expected EEXIST", err)
+    }
+
+    // An existing file is downloaded and updated.
+    f = lookupFile(t, g.root, "a.txt")
+    open := &fuse.OpenRequest{Flags: fuse.OpenReadWrite}
+    if _, err := f.Open(ctx, open, &fuse.OpenResponse{}); err != nil {
+        t.Fatal(err)
+    }
+    write := &fuse.WriteRequest{Offset: 5, Data: []byte(" world")}
+    if err := f.Write(ctx, write, &fuse.WriteResponse{}); err != nil {
+        t.Fatal(err)
+    }
+    if err := f.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+        t.Fatal(err)
+    }
+    f.Release(ctx, &fuse.ReleaseRequest{})
+    checkContent(t, m, a.Id, "hello world")
+
+    // Truncating without a handle uploads right away.
+    setattr := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 5}
+    if err := f.Setattr(ctx, setattr, &fuse.SetattrResponse{}); err != nil {
+        t.Fatal(err)
+    }
+    checkContent(t, m, a.Id, "hello")
+}
+
+func TestUploadRetry(t *testing.T) {
+    r := &failingRemote{MemRemote: MakeMemRemote()}
+    g, done := makeTestFS(t, r)
+    defer done()
+    ctx := context.Background()
+
+    req := &fuse.CreateRequest{Name: "new.txt", Flags: fuse.OpenReadWrite, Mode: 0644}
+    n, _, err := g.root.Create(ctx, req, &fuse.CreateResponse{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    f := n.(*grvFile)
+    f.Write(ctx, &fuse.WriteRequest{Data: []byte("abc")}, &fuse.WriteResponse{})
+    r.err = errRefused
+    if err := f.Flush(ctx, &fuse.FlushRequest{}); err != fuse.EIO {
+        t.Fatalf("Failed upload got %v, expected EIO", err)
+    }
+    f.Release(ctx, &fuse.ReleaseRequest{})
+    if !f.fetcher.held || f.rf.Id != "" {
+        t.Fatal("File which failed to upload is not held")
+    }
+
+    r.err = nil
+    g.retryUploads()
+    if f.fetcher.held || f.rf.Id == "" {
+        t.Fatal("File was not uploaded again")
+    }
+    checkContent(t, r.MemRemote, f.rf.Id, "abc")
+}
+
+func TestUploadRefused(t *testing.T) {
+    r := &failingRemote{MemRemote: MakeMemRemote()}
+    a := r.AddFile(memRootId, "a.txt", []byte("a"))
+    g, done := makeTestFS(t, r)
+    defer done()
+    ctx := context.Background()
+    f := lookupFile(t, g.root, "a.txt")
+    writeFile(t, f, 1, " changed")
+
+    r.err = &RemoteError{Kind: ErrForbidden, Code: http.StatusForbidden,
+        Reason: "insufficientFilePermissions"}
+    if err := f.Flush(ctx, &fuse.FlushRequest{}); err != fuse.EIO {
+        t.Fatalf("Refused upload got %v, expected EIO", err)
+    }
+    f.Release(ctx, &fuse.ReleaseRequest{})
+
+    // Not tried again, the changes are kept aside and the local copy
+    // is not held.
+    if f.fetcher.held || len(g.unsaved) != 0 {
+        t.Error("Refused upload is going to be tried again")
+    }
+    r.err = nil
+    g.retryUploads()
+    checkContent(t, r.MemRemote, a.Id, "a")
+    if got := conflictCopies(t, g); len(got) != 1 || got[0] != "a changed" {
+        t.Errorf("Got conflict copies %q, expected the refused changes", got)
+    }
+}
+
+func TestRemovedWhileChanged(t *testing.T) {
+    m := MakeMemRemote()
+    a := m.AddFile(memRootId, "a.txt", []byte("a"))
+    b := m.AddFile(memRootId, "b.txt", []byte("b"))
+    g, done := makeTestFS(t, m)
+    defer done()
+    ctx := context.Background()
+    fa := lookupFile(t, g.root, "a.txt")
+    fb := lookupFile(t, g.root, "b.txt")
+    writeFile(t, fa, 1, " changed")
+    writeFile(t, fb, 1, " removed")
+
+    // Trashed on the drive, the changes are kept aside.
+    tok, err := m.StartPageToken()
+    if err != nil {
+        t.Fatal(err)
+    }
+    g.changeTok = tok
+    rf, _ := m.GetFileInfo(a.Id)
+    if err := m.Trash(rf); err != nil {
+        t.Fatal(err)
+    }
+    g.syncChanges()
+    if err := fa.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+        t.Fatal(err)
+    }
+    fa.Release(ctx, &fuse.ReleaseRequest{})
+    checkNames(t, g.root, "b.txt")
+    checkContent(t, m, a.Id, "a")
+
+    // Removed here, the changes go with the file.
+    if err := g.root.Remove(ctx, &fuse.RemoveRequest{Name: "b.txt"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := fb.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+        t.Fatal(err)
+    }
+    fb.Release(ctx, &fuse.ReleaseRequest{})
+    checkContent(t, m, b.Id, "b")
+
+    if got := conflictCopies(t, g); len(got) != 1 || got[0] != "a changed" {
+        t.Errorf("Got conflict copies %q, expected the changes of a.txt", got)
+    }
+}
+
+func TestRename(t *testing.T) {
+    m := MakeMemRemote()
+    a := m.AddFile(memRootId, "a.txt", []byte("a"))
+    b := m.AddFile(memRootId, "b.txt", []byte("b"))
+    docs := m.AddDir(memRootId, "docs")
+    empty := m.AddDir(memRootId, "empty")
+    g, done := makeTestFS(t, m)
+    defer done()
+    ctx := context.Background()
+    d := lookupDir(t, g.root, "docs")
+
+    req := &fuse.RenameRequest{OldName: "a.txt", NewName: "c.txt"}
+    if err := g.root.Rename(ctx, req, g.root); err != nil {
+        t.Fatal(err)
+    }
+    checkNames(t, g.root, "b.txt", "c.txt", "docs", "empty")
+    if rf, _ := m.GetFileInfo(a.Id); rf.Title != "c.txt" {
+        t.Errorf("Renamed file has title %s on the drive", rf.Title)
+    }
+
+    req = &fuse.RenameRequest{OldName: "c.txt", NewName: "c.txt"}
+    if err := g.root.Rename(ctx, req, d); err != nil {
+        t.Fatal(err)
+    }
+    checkNames(t, g.root, "b.txt", "docs", "empty")
+    checkNames(t, d, "c.txt")
+    if rf, _ := m.GetFileInfo(a.Id); !hasParent(rf, docs.Id) || hasParent(rf, memRootId) {
+        t.Error("Moved file has wrong parents on the drive")
+    }
+
+    // The existing target is replaced.
+    req = &fuse.RenameRequest{OldName: "b.txt", NewName: "c.txt"}
+    if err := g.root.Rename(ctx, req, d); err != nil {
+        t.Fatal(err)
+    }
+    checkNames(t, g.root, "docs", "empty")
+    checkNames(t, d, "c.txt")
+    if got := readFile(t, lookupFile(t, d, "c.txt")); got != "b" {
+        t.Errorf("Read %q from the replaced file, expected b", got)
+    }
+    checkTrashed(t, m, a.Id, true)
+    checkTrashed(t, m, b.Id, false)
+
+    req = &fuse.RenameRequest{OldName: "missing", NewName: "c.txt"}
+    if err := g.root.Rename(ctx, req, d); err != fuse.ENOENT {
+        t.Errorf("Rename of a missing file got %v, expected ENOENT", err)
+    }
+
+    // A file can't replace a directory, nor a directory a file.
+    req = &fuse.RenameRequest{OldName: "c.txt", NewName: "empty"}
+    if err := d.Rename(ctx, req, g.root); err != fuse.Errno(syscall.EISDIR) {
+        t.Errorf("Rename of a file over a directory got %v, expected EISDIR", err)
+    }
+    req = &fuse.RenameRequest{OldName: "empty", NewName: "c.txt"}
+    if err := g.root.Rename(ctx, req, d); err != fuse.Errno(syscall.ENOTDIR) {
+        t.Errorf("Rename of a directory over a file got %v, expected ENOTDIR", err)
+    }
+    checkNames(t, g.root, "docs", "empty")
+    checkNames(t, d, "c.txt")
+    checkTrashed(t, m, empty.Id, false)
+    checkTrashed(t, m, b.Id, false)
+}
+
+func TestRenameFailureKeepsTarget(t *testing.T) {
+    r := &failingRemote{MemRemote: MakeMemRemote()}
+    a := r.AddFile(memRootId, "a.txt", []byte("a"))
+    b := r.AddFile(memRootId, "b.txt", []byte("b"))
+    g, done := makeTestFS(t, r)
+    defer done()
+
+    r.err = errRefused
+    req := &fuse.RenameRequest{OldName: "a.txt", NewName: "b.txt"}
+    if err := g.root.Rename(context.Background(), req, g.root); err != fuse.EIO {
+        t.Fatalf("Failed rename got %v, expected EIO", err)
+    }
+    checkNames(t, g.root, "a.txt", "b.txt")
+    checkTrashed(t, r.MemRemote, a.Id, false)
+    checkTrashed(t, r.MemRemote, b.Id, false)
+    if got := readFile(t, lookupFile(t, g.root, "b.txt")); got != "b" {
+        t.Errorf("Read %q from the target, expected b", got)
+    }
+}
+
+func TestRemove(t *testing.T) {
+    m := MakeMemRemote()
+    a := m.AddFile(memRootId, "a.txt", []byte("a"))
+    docs := m.AddDir(memRootId, "docs")
+    b := m.AddFile(docs.Id, "b.txt", []byte("b"))
+    g, done := makeTestFS(t, m)
+    defer done()
+    ctx := context.Background()
+
+    if err := g.root.Remove(ctx, &fuse.RemoveRequest{Name: "a.txt"}); err != nil {
+        t.Fatal(err)
+    }
+    checkNames(t, g.root, "docs")
+    checkTrashed(t, m, a.Id, true)
+    if _, err := g.root.Lookup(ctx, "a.txt"); err != fuse.ENOENT {
+        t.Errorf("Lookup of a removed file got %v, expected ENOENT", err)
+    }
+
+    req := &fuse.RemoveRequest{Name: "docs", Dir: true}
+    if err := g.root.Remove(ctx, req); err != fuse.Errno(syscall.ENOTEMPTY) {
+        t.Fatalf("Remove of a full directory got %v, expected ENOTEMPTY", err)
+    }
+    if err := g.root.Remove(ctx, &fuse.RemoveRequest{Name: "docs"}); err != fuse.Errno(syscall.EISDIR) {
+        t.Errorf("Unlink of a directory got %v, expected EISDIR", err)
+    }
+
+    // Deleted instead of trashed when configured so.
+    g.c.HardDelete = true
+    d := lookupDir(t, g.root, "docs")
+    if err := d.Remove(ctx, &fuse.RemoveRequest{Name: "b.txt"}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := m.GetFileInfo(b.Id); err == nil {
+        t.Error("Deleted file is still on the drive")
+    }
+    if err := g.root.Remove(ctx, req); err != nil {
+        t.Fatal(err)
+    }
+    checkNames(t, g.root)
+}
+
+func TestDuplicateTitles(t *testing.T) {
+    m := MakeMemRemote()
+    a := m.AddFile(memRootId, "a.txt", []byte("1"))
+    b := m.AddFile(memRootId, "a.txt", []byte("2"))
+    c := m.AddFile(memRootId, "a.txt", []byte("3"))
+    g, done := makeTestFS(t, m)
+    defer done()
+
+    checkNames(t, g.root, "a ("+b.Id+").txt", "a ("+c.Id+").txt", "a.txt")
+    if got := readFile(t, lookupFile(t, g.root, "a.txt")); got != "1" {
+        t.Errorf("Read %q, expected the oldest file", got)
+    }
+
+    // The next file takes over the name of the removed one.
+    if err := g.root.Remove(context.Background(), &fuse.RemoveRequest{Name: "a.txt"}); err != nil {
+        t.Fatal(err)
+    }
+    checkTrashed(t, m, a.Id, true)
+    checkNames(t, g.root, "a ("+c.Id+").txt", "a.txt")
+    if got := readFile(t, lookupFile(t, g.root, "a.txt")); got != "2" {
+        t.Errorf("Read %q, expected the next file", got)
+    }
+}
+
+func TestEscapedNames(t *testing.T) {
+    m := MakeMemRemote()
+    g, done := makeTestFS(t, m)
+    defer done()
+    ctx := context.Background()
+
+    for name, title := range map[string]string{
+        "a⧵∕b":  "a∕b",
+        "c∕d":   "c/d",
+        "⧵．":    "．",
+        "a⧵b":   "a⧵b",
+        "e⧵⧵∕f": "e⧵/f",
+        "g⧵":    "g⧵",
+    } {
+        req := &fuse.CreateRequest{Name: name, Flags: fuse.OpenReadWrite, Mode: 0644}
+        n, _, err := g.root.Create(ctx, req, &fuse.CreateResponse{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        f := n.(*grvFile)
+        f.Flush(ctx, &fuse.FlushRequest{})
+        f.Release(ctx, &fuse.ReleaseRequest{})
+        rf, err := m.GetFileInfo(f.rf.Id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if rf.Title != title {
+            t.Errorf("Created %s with title %s, expected %s", name, rf.Title, title)
+        }
+        if lookupFile(t, g.root, name) != f {
+            t.Errorf("Lookup of %s returned another node", name)
+        }
+    }
+
+    // No title gives these names, the files would be named otherwise.
+    req := &fuse.CreateRequest{Name: "⧵⧵．", Flags: fuse.OpenReadWrite, Mode: 0644}
+    if _, _, err := g.root.Create(ctx, req, &fuse.CreateResponse{}); err != fuse.Errno(syscall.EINVAL) {
+        t.Errorf("Create of an invalid name got %v, expected EINVAL", err)
+    }
+    rename := &fuse.RenameRequest{OldName: "a⧵b", NewName: "⧵⧵．"}
+    if err := g.root.Rename(ctx, rename, g.root); err != fuse.Errno(syscall.EINVAL) {
+        t.Errorf("Rename to an invalid name got %v, expected EINVAL", err)
+    }
+
+    // A fresh listing decodes the same names back.
+    g.root.loaded = g.root.loaded.AddDate(-1, 0, 0)
+    checkNames(t, g.root, "a⧵b", "a⧵∕b", "c∕d", "e⧵⧵∕f", "g⧵", "⧵．")
+}
+
+//
+func nlink(f *grvFile) uint32 {
+    var a fuse.Attr
+    f.Attr(&a)
+    return a.Nlink
+}
+
+func TestMultipleParents(t *testing.T) {
+    m := MakeMemRemote()
+    a := m.AddFile(memRootId, "a.txt", []byte("a"))
+    docs := m.AddDir(memRootId, "docs")
+    if _, err := m.Move(a, a.Title, "", docs.Id); err != nil {
+        t.Fatal(err)
+    }
+    g, done := makeTestFS(t, m)
+    defer done()
+    ctx := context.Background()
+
+    // Both links are counted before the other directory is listed.
+    f := lookupFile(t, g.root, "a.txt")
+    if n := nlink(f); n != 2 {
+        t.Errorf("File has %d links before listing docs, expected 2", n)
+    }
+    d := lookupDir(t, g.root, "docs")
+    o := lookupFile(t, d, "a.txt")
+    if o != f || o.fetcher != f.fetcher || o.attr.Inode != f.attr.Inode {
+        t.Fatal("File has another node in the other directory")
+    }
+    if n := nlink(f); n != 2 {
+        t.Errorf("File has %d links, expected 2", n)
+    }
+
+    // The changes made through one path are seen through the other.
+    writeFile(t, f, 1, "b")
+    if err := f.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+        t.Fatal(err)
+    }
+    f.Release(ctx, &fuse.ReleaseRequest{})
+    if got := readFile(t, lookupFile(t, d, "a.txt")); got != "ab" {
+        t.Errorf("Read %q through docs, expected ab", got)
+    }
+
+    // Removed from one directory it stays in the other.
+    if err := d.Remove(ctx, &fuse.RemoveRequest{Name: "a.txt"}); err != nil {
+        t.Fatal(err)
+    }
+    checkNames(t, d)
+    checkNames(t, g.root, "a.txt", "docs")
+    checkTrashed(t, m, a.Id, false)
+    if n := nlink(f); n != 1 {
+        t.Errorf("File has %d links, expected 1", n)
+    }
+}
+
+func TestApplyChanges(t *testing.T) {
+    m := MakeMemRemote()
+    a := m.AddFile(memRootId, "a.txt", []byte("a"))
+    b := m.AddFile(memRootId, "b.txt", []byte("b"))
+    docs := m.AddDir(memRootId, "docs")
+    g, done := makeTestFS(t, m)
+    defer done()
+    d := lookupDir(t, g.root, "docs")
+    checkNames(t, g.root, "a.txt", "b.txt", "docs")
+    checkNames(t, d)
+
+    tok, err := m.StartPageToken()
+    if err != nil {
+        t.Fatal(err)
+    }
+    g.changeTok = tok
+    m.AddFile(memRootId, "new.txt", []byte("new"))
+    rf, _ := m.GetFileInfo(a.Id)
+    if _, err := m.Move(rf, "moved.txt", memRootId, docs.Id); err != nil {
+        t.Fatal(err)
+    }
+    rf, _ = m.GetFileInfo(b.Id)
+    if err := m.Trash(rf); err != nil {
+        t.Fatal(err)
+    }
+    g.syncChanges()
+
+    checkNames(t, g.root, "docs", "new.txt")
+    checkNames(t, d, "moved.txt")
+    if got := readFile(t, lookupFile(t, g.root, "new.txt")); got != "new" {
+        t.Errorf("Read %q, expected new", got)
+    }
+    if got := readFile(t, lookupFile(t, d, "moved.txt")); got != "a" {
+        t.Errorf("Read %q, expected a", got)
+    }
+}
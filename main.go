@@ -13,6 +13,7 @@ import (
     "os"
     "os/user"
     "path"
+    "path/filepath"
     "strconv"
 )
 
@@ -23,13 +24,31 @@ const (
 // enable fuse logging of debug messages to stderr.
 var fusedebug = flag.Bool("fusedebug", false, "enable fuse debugging to stderr")
 var verbose = flag.Bool("v", false, "enable debugging messages to stderr")
+var readOnly = flag.Bool("ro", false, "mount the drive read-only")
+var sharedDrive = flag.String("drive", "",
+    "mount the shared drive with this name or id instead of My Drive")
+var rootFolder = flag.String("root", "",
+    "mount the folder with this id or path, e.g. /Projects/Alpha, as the root")
+var headless = flag.Bool("headless", false,
+    "authorize by pasting the address the browser is redirected to")
+var keyFile = flag.String("key", "",
+    "use the service account with this JSON key instead of the user")
+var subject = flag.String("subject", "",
+    "email of the user the service account acts for")
 var dir = flag.String("dir", "",
     "set the grivefs cache and config directory, default is ~/.grivefs")
 
+// flags of the auth command.
+var authFlags = flag.NewFlagSet("auth", flag.ExitOnError)
+var device = authFlags.Bool("device", false,
+    "authorize by entering a code on another device")
+
 var Usage = func() {
     fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
     fmt.Fprintf(os.Stderr, "  %s MOUNTPOINT\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "  %s auth [-device]\n", os.Args[0])
     flag.PrintDefaults()
+    authFlags.PrintDefaults()
 }
 
 func init() {
@@ -51,7 +70,8 @@ func main() {
     flag.Usage = Usage
     flag.Parse()
 
-    if flag.NArg() != 1 {
+    auth := flag.Arg(0) == "auth"
+    if flag.NArg() != 1 && !auth {
         Usage()
         os.Exit(2)
     }
@@ -74,24 +94,48 @@ func main() {
     if err != nil {
         log.Fatal(err)
     }
+    conf.Drive = *sharedDrive
+    conf.Root = *rootFolder
+    conf.Headless = *headless
+    conf.ReadOnly = *readOnly
+    if *keyFile != "" {
+        if conf.ServiceAccount, err = filepath.Abs(*keyFile); err != nil {
+            log.Fatal(err)
+        }
+    }
+    if *subject != "" {
+        conf.Subject = *subject
+    }
+
+    if auth {
+        authorizeMain(conf, flag.Args()[1:])
+        return
+    }
 
     uid, _ := strconv.Atoi(usr.Uid)
     gid, _ := strconv.Atoi(usr.Gid)
-    f, err := MakeGriveFS(conf, uint32(uid), uint32(gid))
+    log.Info("Connecting ....")
+    r, err := MakeRemote(conf)
+    if err != nil {
+        log.Fatal(err)
+    }
+    f, err := MakeGriveFS(conf, r, uint32(uid), uint32(gid))
     if err != nil {
         log.Fatal(err)
     }
     defer f.Destroy()
 
     mountpoint := flag.Arg(0)
-    c, err := fuse.Mount(
-        mountpoint,
+    options := []fuse.MountOption{
         fuse.FSName("grivefs"),
         fuse.Subtype("googledrivefs"),
         fuse.LocalVolume(),
         fuse.VolumeName("Google Drive FS"),
-        fuse.ReadOnly(),
-    )
+    }
+    if *readOnly {
+        options = append(options, fuse.ReadOnly())
+    }
+    c, err := fuse.Mount(mountpoint, options...)
     defer c.Close()
     if err != nil {
         log.Fatal(err)
@@ -116,3 +160,17 @@ func main() {
     }
     log.Info("FUSE server stopped")
 }
+
+// Authorizes grivefs to access the drive without mounting it, the
+// refresh token is stored in the configuration.
+func authorizeMain(conf *Config, args []string) {
+    authFlags.Parse(args)
+    if conf.ServiceAccount != "" {
+        log.Info("The service account needs no authorization")
+        return
+    }
+    if _, err := authorizeConfig(conf, *device); err != nil {
+        log.Fatal(err)
+    }
+    log.Infof("Authorized, the token is stored in %s", conf.Path)
+}
@@ -0,0 +1,405 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/hex"
+    "fmt"
+    drive "google.golang.org/api/drive/v2"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    memRootId string = "root"
+    // Folder of another user the shared files are in.
+    memForeignId string = "foreign"
+)
+
+var (
+    ErrMemNotFound error = &RemoteError{
+        Kind:    ErrNotFound,
+        Code:    http.StatusNotFound,
+        Reason:  "notFound",
+        Message: "File not found",
+    }
+)
+
+// Drive kept in memory, it behaves like google drive closely enough
+// to run the file system against it in tests. Every change is recorded
+// in the changes feed.
+type MemRemote struct {
+    sync.Mutex
+    files   map[string]*drive.File
+    content map[string][]byte
+    changes []*drive.Change
+    lastId  uint64
+}
+
+var _ DriveBackend = (*MemRemote)(nil)
+
+// Creates an empty drive with just the root folder.
+func MakeMemRemote() *MemRemote {
+    m := &MemRemote{
+        files:   make(map[string]*drive.File),
+        content: make(map[string][]byte),
+    }
+    m.files[memRootId] = &drive.File{
+        Id:           memRootId,
+        Title:        "My Drive",
+        MimeType:     mimeFolder,
+        Etag:         "1",
+        CreatedDate:  time.Now().UTC().Format(time.RFC3339),
+        ModifiedDate: time.Now().UTC().Format(time.RFC3339),
+    }
+    return m
+}
+
+// Adds a file with the content to the parent directory, as if it was
+// created by another client. It returns the new file.
+func (m *MemRemote) AddFile(parentId string, title string, content []byte) *drive.File {
+    m.Lock()
+    defer m.Unlock()
+    f := &drive.File{
+        Id:          m.newId(),
+        Title:       title,
+        DriveId:     m.driveOf(parentId),
+        CreatedDate: time.Now().UTC().Format(time.RFC3339),
+        Parents:     []*drive.ParentReference{{Id: parentId}},
+    }
+    m.setContent(f, content)
+    m.files[f.Id] = f
+    m.record(f, false)
+    return copyFile(f)
+}
+
+// Adds a directory to the parent directory, as if it was created by
+// another client. It returns the new directory.
+func (m *MemRemote) AddDir(parentId string, title string) *drive.File {
+    m.Lock()
+    defer m.Unlock()
+    f := &drive.File{
+        Id:           m.newId(),
+        Title:        title,
+        MimeType:     mimeFolder,
+        DriveId:      m.driveOf(parentId),
+        Etag:         "1",
+        CreatedDate:  time.Now().UTC().Format(time.RFC3339),
+        ModifiedDate: time.Now().UTC().Format(time.RFC3339),
+        Parents:      []*drive.ParentReference{{Id: parentId}},
+    }
+    m.files[f.Id] = f
+    m.record(f, false)
+    return copyFile(f)
+}
+
+// Adds a file with the content shared with the user by another one,
+// it is in a folder of the other user the drive does not know about.
+// It returns the new file.
+func (m *MemRemote) AddShared(title string, content []byte) *drive.File {
+    m.Lock()
+    defer m.Unlock()
+    f := &drive.File{
+        Id:               m.newId(),
+        Title:            title,
+        CreatedDate:      time.Now().UTC().Format(time.RFC3339),
+        SharedWithMeDate: time.Now().UTC().Format(time.RFC3339),
+        Parents:          []*drive.ParentReference{{Id: memForeignId}},
+    }
+    m.setContent(f, content)
+    m.files[f.Id] = f
+    m.record(f, false)
+    return copyFile(f)
+}
+
+// Adds a shared drive, the user can only read its files unless it is
+// writable. It returns the root folder of the drive.
+func (m *MemRemote) AddDrive(name string, writable bool) *drive.File {
+    m.Lock()
+    defer m.Unlock()
+    id := m.newId()
+    f := &drive.File{
+        Id:           id,
+        DriveId:      id,
+        Title:        name,
+        MimeType:     mimeFolder,
+        Etag:         "1",
+        CreatedDate:  time.Now().UTC().Format(time.RFC3339),
+        ModifiedDate: time.Now().UTC().Format(time.RFC3339),
+        Capabilities: &drive.FileCapabilities{
+            CanAddChildren:  writable,
+            CanDownload:     true,
+            CanEdit:         writable,
+            CanListChildren: true,
+        },
+    }
+    m.files[f.Id] = f
+    return copyFile(f)
+}
+
+// Content of the file as stored in the drive.
+func (m *MemRemote) Content(fileId string) ([]byte, error) {
+    m.Lock()
+    defer m.Unlock()
+    c, ok := m.content[fileId]
+    if !ok {
+        return nil, ErrMemNotFound
+    }
+    return append([]byte(nil), c...), nil
+}
+
+//
+func (m *MemRemote) GetRootFile() (*drive.File, error) {
+    return m.GetFileInfo(memRootId)
+}
+
+//
+func (m *MemRemote) ListDir(dir *drive.File) ([]*drive.File, error) {
+    m.Lock()
+    defer m.Unlock()
+    var fs []*drive.File
+    for _, f := range m.files {
+        if hasParent(f, dir.Id) {
+            fs = append(fs, copyFile(f))
+        }
+    }
+    return fs, nil
+}
+
+//
+func (m *MemRemote) ListShared() ([]*drive.File, error) {
+    m.Lock()
+    defer m.Unlock()
+    var fs []*drive.File
+    for _, f := range m.files {
+        if f.SharedWithMeDate != "" {
+            fs = append(fs, copyFile(f))
+        }
+    }
+    return fs, nil
+}
+
+//
+func (m *MemRemote) ListDrives() ([]*drive.File, error) {
+    m.Lock()
+    defer m.Unlock()
+    var fs []*drive.File
+    for _, f := range m.files {
+        if isDriveRoot(f) {
+            fs = append(fs, copyFile(f))
+        }
+    }
+    return fs, nil
+}
+
+//
+func (m *MemRemote) GetFileInfo(fileId string) (*drive.File, error) {
+    m.Lock()
+    defer m.Unlock()
+    f, ok := m.files[fileId]
+    if !ok {
+        return nil, ErrMemNotFound
+    }
+    return copyFile(f), nil
+}
+
+// The token is the number of changes made so far.
+func (m *MemRemote) StartPageToken() (string, error) {
+    m.Lock()
+    defer m.Unlock()
+    return strconv.Itoa(len(m.changes)), nil
+}
+
+//
+func (m *MemRemote) ListChanges(token string) ([]*drive.Change, string, error) {
+    m.Lock()
+    defer m.Unlock()
+    n, err := strconv.Atoi(token)
+    if err != nil || n < 0 || n > len(m.changes) {
+        return nil, "", fmt.Errorf("Invalid page token %q", token)
+    }
+    cs := append([]*drive.Change(nil), m.changes[n:]...)
+    return cs, strconv.Itoa(len(m.changes)), nil
+}
+
+//
+func (m *MemRemote) Upload(f *drive.File, r io.Reader) (*drive.File, error) {
+    content, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    m.Lock()
+    defer m.Unlock()
+    nf := copyFile(f)
+    nf.Id = m.newId()
+    nf.CreatedDate = time.Now().UTC().Format(time.RFC3339)
+    if len(nf.Parents) > 0 {
+        nf.DriveId = m.driveOf(nf.Parents[0].Id)
+    }
+    m.setContent(nf, content)
+    m.files[nf.Id] = nf
+    m.record(nf, false)
+    return copyFile(nf), nil
+}
+
+// The update is refused with ErrConflict when the etag doesn't match,
+// just like the If-Match header does.
+func (m *MemRemote) Update(f *drive.File, r io.Reader) (*drive.File, error) {
+    content, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    m.Lock()
+    defer m.Unlock()
+    cur, ok := m.files[f.Id]
+    if !ok {
+        return nil, ErrMemNotFound
+    }
+    if f.Etag != cur.Etag {
+        return nil, ErrConflict
+    }
+    m.setContent(cur, content)
+    m.record(cur, false)
+    return copyFile(cur), nil
+}
+
+//
+func (m *MemRemote) Mkdir(parent *drive.File, title string) (*drive.File, error) {
+    if _, err := m.GetFileInfo(parent.Id); err != nil {
+        return nil, err
+    }
+    return m.AddDir(parent.Id, title), nil
+}
+
+//
+func (m *MemRemote) Move(f *drive.File, title string, from string, to string) (*drive.File, error) {
+    m.Lock()
+    defer m.Unlock()
+    cur, ok := m.files[f.Id]
+    if !ok {
+        return nil, ErrMemNotFound
+    }
+    cur.Title = title
+    if from != to {
+        var ps []*drive.ParentReference
+        for _, p := range cur.Parents {
+            if p.Id != from {
+                ps = append(ps, p)
+            }
+        }
+        if to != "" {
+            ps = append(ps, &drive.ParentReference{Id: to})
+        }
+        cur.Parents = ps
+    }
+    m.touch(cur)
+    m.record(cur, false)
+    return copyFile(cur), nil
+}
+
+//
+func (m *MemRemote) Trash(f *drive.File) error {
+    m.Lock()
+    defer m.Unlock()
+    cur, ok := m.files[f.Id]
+    if !ok {
+        return ErrMemNotFound
+    }
+    cur.Labels = &drive.FileLabels{Trashed: true}
+    m.touch(cur)
+    m.record(cur, false)
+    return nil
+}
+
+//
+func (m *MemRemote) Delete(f *drive.File) error {
+    m.Lock()
+    defer m.Unlock()
+    cur, ok := m.files[f.Id]
+    if !ok {
+        return ErrMemNotFound
+    }
+    delete(m.files, f.Id)
+    delete(m.content, f.Id)
+    m.record(cur, true)
+    return nil
+}
+
+//
+func (m *MemRemote) Download(f *drive.File, off int64, size int64) (io.ReadCloser, error) {
+    m.Lock()
+    defer m.Unlock()
+    c, ok := m.content[f.Id]
+    if !ok {
+        return nil, ErrMemNotFound
+    }
+    if off > int64(len(c)) {
+        off = int64(len(c))
+    }
+    end := int64(len(c))
+    if size > 0 && off+size < end {
+        end = off + size
+    }
+    return ioutil.NopCloser(bytes.NewReader(c[off:end])), nil
+}
+
+// Google Apps files have no content in memory, they are exported as
+// their title.
+func (m *MemRemote) Export(f *drive.File, mime string) (io.ReadCloser, error) {
+    cur, err := m.GetFileInfo(f.Id)
+    if err != nil {
+        return nil, err
+    }
+    if cur.ExportLinks[mime] == "" {
+        return nil, fmt.Errorf("File can't be exported as %s", mime)
+    }
+    return ioutil.NopCloser(bytes.NewBufferString(cur.Title)), nil
+}
+
+// Id of the shared drive the file is in, empty for the files of the
+// user.
+func (m *MemRemote) driveOf(fileId string) string {
+    if f, ok := m.files[fileId]; ok {
+        return f.DriveId
+    }
+    return ""
+}
+
+//
+func (m *MemRemote) newId() string {
+    m.lastId++
+    return fmt.Sprintf("mem%d", m.lastId)
+}
+
+// Stores the content and updates the metadata depending on it.
+func (m *MemRemote) setContent(f *drive.File, content []byte) {
+    sum := md5.Sum(content)
+    m.content[f.Id] = content
+    f.FileSize = int64(len(content))
+    f.Md5Checksum = hex.EncodeToString(sum[:])
+    m.touch(f)
+}
+
+// Bumps the etag and the modification time of the file.
+func (m *MemRemote) touch(f *drive.File) {
+    n, _ := strconv.Atoi(f.Etag)
+    f.Etag = strconv.Itoa(n + 1)
+    f.ModifiedDate = time.Now().UTC().Format(time.RFC3339)
+}
+
+//
+func (m *MemRemote) record(f *drive.File, deleted bool) {
+    c := &drive.Change{FileId: f.Id, Deleted: deleted}
+    if !deleted {
+        c.File = copyFile(f)
+    }
+    m.changes = append(m.changes, c)
+}
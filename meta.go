@@ -0,0 +1,366 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    log "github.com/Sirupsen/logrus"
+    drive "google.golang.org/api/drive/v2"
+    "hash/fnv"
+    "io/ioutil"
+    "math/rand"
+    "os"
+    "path"
+    "sync"
+)
+
+const (
+    metaFile = ".metadata.json"
+    // The metadata of other mount roots, by the hash of the root.
+    metaRootFile = ".metadata-%08x.json"
+    // Inode of the root of the mount.
+    rootInode = 1
+    // Inodes up to this one are reserved, the drive files never get them.
+    lastReservedInode = rootInode
+)
+
+// Metadata of the drive kept between the mounts, the listings of the
+// directories together with the change token they are valid at so a
+// remount can show them right away and catch up with the changes
+// feed. It also keeps the inodes of the files so they don't change.
+type metaStore struct {
+    sync.Mutex
+    path  string
+    dirty bool
+    snap  metaSnapshot
+    // The ids by inode, to find the free inodes.
+    used map[uint64]string
+    // The ids of the stored files by the id of their parent.
+    children map[string]map[string]bool
+}
+
+// What is stored on the disk.
+type metaSnapshot struct {
+    Token  string                 `json:"change_token"`
+    RootId string                 `json:"root_id"`
+    Files  map[string]*drive.File `json:"files"`
+    Listed map[string]bool        `json:"listed"`
+    Inodes map[string]uint64      `json:"inodes"`
+}
+
+// Path of the metadata of the mount, a shared drive or a folder
+// mounted as the root has its own.
+func metaPath(c *Config) string {
+    if c.Drive == "" && c.Root == "" {
+        return path.Join(c.DataDir, metaFile)
+    }
+    h := fnv.New32a()
+    h.Write([]byte(c.Drive))
+    if c.Root != "" {
+        h.Write([]byte{0})
+        h.Write([]byte(c.Root))
+    }
+    return path.Join(c.DataDir, fmt.Sprintf(metaRootFile, h.Sum32()))
+}
+
+// Loads the metadata stored in the file, a missing or broken file
+// gives an empty store.
+func loadMetaStore(file string) *metaStore {
+    logger := log.WithField("func", "meta.go:loadMetaStore")
+    m := &metaStore{path: file}
+    data, err := ioutil.ReadFile(m.path)
+    if err == nil {
+        err = json.Unmarshal(data, &m.snap)
+    }
+    if err != nil && !os.IsNotExist(err) {
+        logger.Warn(err)
+        m.snap = metaSnapshot{}
+    }
+    if m.snap.Files == nil {
+        m.snap.Files = make(map[string]*drive.File)
+    }
+    if m.snap.Listed == nil {
+        m.snap.Listed = make(map[string]bool)
+    }
+    if m.snap.Inodes == nil {
+        m.snap.Inodes = make(map[string]uint64)
+    }
+    m.used = make(map[uint64]string)
+    for id, ino := range m.snap.Inodes {
+        m.used[ino] = id
+    }
+    m.children = make(map[string]map[string]bool)
+    for _, f := range m.snap.Files {
+        m.index(f)
+    }
+    logger.Debugf("Loaded %d files", len(m.snap.Files))
+    return m
+}
+
+// Writes the metadata to the disk if it changed, the old file is
+// replaced only once the new one is complete.
+func (m *metaStore) save() error {
+    m.Lock()
+    defer m.Unlock()
+    if !m.dirty {
+        return nil
+    }
+    data, err := json.Marshal(&m.snap)
+    if err != nil {
+        return err
+    }
+    out, err := ioutil.TempFile(path.Dir(m.path), metaFile+"-")
+    if err != nil {
+        return err
+    }
+    _, err = out.Write(data)
+    if cerr := out.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(out.Name(), m.path)
+    }
+    if err != nil {
+        os.Remove(out.Name())
+        return err
+    }
+    m.dirty = false
+    return nil
+}
+
+// Forgets the listings, they can't be trusted without a change token.
+// The inodes are kept.
+func (m *metaStore) reset() {
+    m.Lock()
+    defer m.Unlock()
+    m.snap.Token = ""
+    m.snap.RootId = ""
+    m.snap.Files = make(map[string]*drive.File)
+    m.snap.Listed = make(map[string]bool)
+    m.children = make(map[string]map[string]bool)
+    m.dirty = true
+}
+
+// The change token the metadata is valid at.
+func (m *metaStore) token() string {
+    m.Lock()
+    defer m.Unlock()
+    return m.snap.Token
+}
+
+//
+func (m *metaStore) setToken(tok string) {
+    m.Lock()
+    defer m.Unlock()
+    if m.snap.Token != tok {
+        m.snap.Token = tok
+        m.dirty = true
+    }
+}
+
+// The stored root folder or nil.
+func (m *metaStore) root() *drive.File {
+    m.Lock()
+    defer m.Unlock()
+    if f, ok := m.snap.Files[m.snap.RootId]; ok {
+        return copyFile(f)
+    }
+    return nil
+}
+
+//
+func (m *metaStore) setRoot(f *drive.File) {
+    m.Lock()
+    defer m.Unlock()
+    m.store(f)
+    m.snap.RootId = f.Id
+    m.dirty = true
+}
+
+// Stores the new metadata of the file.
+func (m *metaStore) put(f *drive.File) {
+    m.Lock()
+    defer m.Unlock()
+    m.store(f)
+    m.dirty = true
+}
+
+//
+func (m *metaStore) remove(id string) {
+    m.Lock()
+    defer m.Unlock()
+    if f, ok := m.snap.Files[id]; ok {
+        m.unindex(f)
+        delete(m.snap.Files, id)
+        m.dirty = true
+    }
+}
+
+// Stores the complete listing of the directory, the files no longer
+// in it are taken out of it and dropped when they are in no other
+// directory.
+func (m *metaStore) setListing(dirId string, files []*drive.File) {
+    m.Lock()
+    defer m.Unlock()
+    for id := range m.children[dirId] {
+        if id == m.snap.RootId {
+            continue
+        }
+        f := m.snap.Files[id]
+        var ps []*drive.ParentReference
+        for _, p := range f.Parents {
+            if p.Id != dirId {
+                ps = append(ps, p)
+            }
+        }
+        delete(m.children[dirId], id)
+        if len(ps) == 0 {
+            delete(m.snap.Files, id)
+        } else {
+            f.Parents = ps
+        }
+    }
+    if len(m.children[dirId]) == 0 {
+        delete(m.children, dirId)
+    }
+    for _, f := range files {
+        m.store(f)
+    }
+    m.snap.Listed[dirId] = true
+    m.dirty = true
+}
+
+// The stored listing of the directory, false when it was never
+// listed.
+func (m *metaStore) listing(dirId string) ([]*drive.File, bool) {
+    m.Lock()
+    defer m.Unlock()
+    if !m.snap.Listed[dirId] {
+        return nil, false
+    }
+    fs := make([]*drive.File, 0, len(m.children[dirId]))
+    for id := range m.children[dirId] {
+        fs = append(fs, copyFile(m.snap.Files[id]))
+    }
+    return fs, true
+}
+
+// Replaces the stored file, only the fields the mount needs are kept
+// so the metadata stays small. The caller holds the lock.
+func (m *metaStore) store(f *drive.File) {
+    if old, ok := m.snap.Files[f.Id]; ok {
+        m.unindex(old)
+    }
+    sf := &drive.File{
+        Id:                 f.Id,
+        Title:              f.Title,
+        MimeType:           f.MimeType,
+        FileSize:           f.FileSize,
+        Md5Checksum:        f.Md5Checksum,
+        Etag:               f.Etag,
+        CreatedDate:        f.CreatedDate,
+        ModifiedDate:       f.ModifiedDate,
+        LastViewedByMeDate: f.LastViewedByMeDate,
+        SharedWithMeDate:   f.SharedWithMeDate,
+        DriveId:            f.DriveId,
+        DownloadUrl:        f.DownloadUrl,
+        ExportLinks:        f.ExportLinks,
+        AlternateLink:      f.AlternateLink,
+    }
+    for _, p := range f.Parents {
+        sf.Parents = append(sf.Parents, &drive.ParentReference{Id: p.Id, IsRoot: p.IsRoot})
+    }
+    if f.Labels != nil {
+        l := *f.Labels
+        sf.Labels = &l
+    }
+    if f.Capabilities != nil {
+        c := *f.Capabilities
+        sf.Capabilities = &c
+    }
+    m.snap.Files[f.Id] = sf
+    m.index(sf)
+}
+
+// Copy of the file which can be changed without touching the drive.
+func copyFile(f *drive.File) *drive.File {
+    nf := *f
+    nf.Parents = nil
+    for _, p := range f.Parents {
+        pr := *p
+        nf.Parents = append(nf.Parents, &pr)
+    }
+    if f.Labels != nil {
+        l := *f.Labels
+        nf.Labels = &l
+    }
+    return &nf
+}
+
+// Adds the stored file to the children of its parents. The caller
+// holds the lock.
+func (m *metaStore) index(f *drive.File) {
+    for _, p := range f.Parents {
+        ids := m.children[p.Id]
+        if ids == nil {
+            ids = make(map[string]bool)
+            m.children[p.Id] = ids
+        }
+        ids[f.Id] = true
+    }
+}
+
+// Takes the stored file out of the children of its parents. The
+// caller holds the lock.
+func (m *metaStore) unindex(f *drive.File) {
+    for _, p := range f.Parents {
+        delete(m.children[p.Id], f.Id)
+        if len(m.children[p.Id]) == 0 {
+            delete(m.children, p.Id)
+        }
+    }
+}
+
+// Inode of the drive file, it is the same on every mount. The inode
+// is derived from the id so it is the same even when the metadata is
+// lost, on a collision the next free inode is taken and remembered.
+// Files not uploaded yet get a random free inode.
+func (m *metaStore) inode(id string) uint64 {
+    m.Lock()
+    defer m.Unlock()
+    if ino, ok := m.snap.Inodes[id]; ok && id != "" {
+        return ino
+    }
+    var ino uint64
+    if id != "" {
+        h := fnv.New64a()
+        h.Write([]byte(id))
+        ino = h.Sum64()
+    } else {
+        ino = uint64(rand.Int63())
+    }
+    for {
+        if _, taken := m.used[ino]; !taken && ino > lastReservedInode {
+            break
+        }
+        ino++
+    }
+    m.used[ino] = id
+    if id != "" {
+        m.snap.Inodes[id] = ino
+        m.dirty = true
+    }
+    return ino
+}
+
+// Keeps the inode of a new file once it gets its id.
+func (m *metaStore) setInode(id string, ino uint64) {
+    m.Lock()
+    defer m.Unlock()
+    m.used[ino] = id
+    m.snap.Inodes[id] = ino
+    m.dirty = true
+}
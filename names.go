@@ -0,0 +1,263 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+import (
+    "bazil.org/fuse"
+    "bytes"
+    log "github.com/Sirupsen/logrus"
+    "golang.org/x/net/context"
+    drive "google.golang.org/api/drive/v2"
+    "path"
+    "sort"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    // Extended attribute with the id of the drive file.
+    xattrId = "user.grivefs.id"
+    // Number of characters of the id telling duplicate titles apart.
+    shortIdLen = 8
+    // Stands for the dots of the titles "." and "..".
+    dotName = "\uff0e"
+    // Goes before the replacements and itself when they are in the
+    // title, so the names always give back the title.
+    nameEscape = "\u29f5"
+)
+
+// Turns the titles into names and back. The parts of the titles not
+// allowed in names are replaced by the rules, a replacement which is
+// in the title gets escaped by nameEscape. The escapes in front of a
+// replacement are doubled, elsewhere they are kept as they are.
+type nameCodec struct {
+    parts  []string
+    repls  []string
+    rules  map[string]string
+    titles map[string]string
+}
+
+// Codec of the name rules, the rules replacing with a slash, NUL or
+// nothing are skipped. The rules are sorted so the names are the same
+// on every mount.
+func makeNameCodec(rules map[string]string) *nameCodec {
+    c := &nameCodec{rules: make(map[string]string), titles: make(map[string]string)}
+    for k, v := range rules {
+        if k == "" || v == "" || strings.ContainsAny(v, "/\x00") ||
+            strings.Contains(k+v, nameEscape) {
+            log.WithField("func", "names.go:makeNameCodec").
+                Warnf("Ignoring name rule %q -> %q", k, v)
+            continue
+        }
+        c.parts = append(c.parts, k)
+        c.repls = append(c.repls, v)
+        c.rules[k] = v
+        c.titles[v] = k
+    }
+    sort.Strings(c.parts)
+    sort.Strings(c.repls)
+    return c
+}
+
+// The first of the strings s starts with.
+func matchPrefix(s string, prefixes []string) string {
+    for _, p := range prefixes {
+        if strings.HasPrefix(s, p) {
+            return p
+        }
+    }
+    return ""
+}
+
+// Name made of the title.
+func (c *nameCodec) encode(title string) string {
+    var b bytes.Buffer
+    escapes := 0
+    for len(title) > 0 {
+        if strings.HasPrefix(title, nameEscape) {
+            escapes++
+            title = title[len(nameEscape):]
+            continue
+        }
+        if k := matchPrefix(title, c.parts); k != "" {
+            b.WriteString(strings.Repeat(nameEscape, 2*escapes) + c.rules[k])
+            title = title[len(k):]
+        } else if r := matchPrefix(title, c.repls); r != "" {
+            b.WriteString(strings.Repeat(nameEscape, 2*escapes+1) + r)
+            title = title[len(r):]
+        } else {
+            _, n := utf8.DecodeRuneInString(title)
+            b.WriteString(strings.Repeat(nameEscape, escapes) + title[:n])
+            title = title[n:]
+        }
+        escapes = 0
+    }
+    b.WriteString(strings.Repeat(nameEscape, escapes))
+    return b.String()
+}
+
+// Title the name stands for, the reverse of encode.
+func (c *nameCodec) decode(name string) string {
+    var b bytes.Buffer
+    escapes := 0
+    for len(name) > 0 {
+        if strings.HasPrefix(name, nameEscape) {
+            escapes++
+            name = name[len(nameEscape):]
+            continue
+        }
+        if r := matchPrefix(name, c.repls); r != "" {
+            b.WriteString(strings.Repeat(nameEscape, escapes/2))
+            if escapes%2 == 1 {
+                b.WriteString(r)
+            } else {
+                b.WriteString(c.titles[r])
+            }
+            name = name[len(r):]
+        } else {
+            _, n := utf8.DecodeRuneInString(name)
+            b.WriteString(strings.Repeat(nameEscape, escapes) + name[:n])
+            name = name[n:]
+        }
+        escapes = 0
+    }
+    b.WriteString(strings.Repeat(nameEscape, escapes))
+    return b.String()
+}
+
+// Splits the title made of escapes and the dots of the titles "." and
+// ".." into the number of the escapes and the dots.
+func splitDots(s string) (int, string, bool) {
+    dots := strings.TrimLeft(s, nameEscape)
+    if dots != dotName && dots != dotName+dotName {
+        return 0, "", false
+    }
+    return (len(s) - len(dots)) / len(nameEscape), dots, true
+}
+
+// Name made of the title, the parts of the title not allowed in names
+// are replaced by the name rules. The dots standing for the titles
+// "." and ".." are escaped like the replacements when in the title.
+func (g *griveFS) encodeName(title string) string {
+    switch title {
+    case ".", "..":
+        return strings.Repeat(dotName, len(title))
+    }
+    if n, dots, ok := splitDots(title); ok {
+        return strings.Repeat(nameEscape, 2*n+1) + dots
+    }
+    return g.codec.encode(title)
+}
+
+// Title the name stands for, the reverse of encodeName. A name using
+// the replacements on purpose gets the original characters too, the
+// escaped ones are kept as they are.
+func (g *griveFS) decodeName(name string) string {
+    if n, dots, ok := splitDots(name); ok {
+        if n == 0 {
+            return strings.Repeat(".", len(dots)/len(dotName))
+        }
+        if n%2 == 1 {
+            return strings.Repeat(nameEscape, n/2) + dots
+        }
+    }
+    return g.codec.decode(name)
+}
+
+// Whether the name is the name of a title. The names with the parts
+// the rules replace or with escapes no title gets can't be given to
+// files, the file would get another name.
+func (g *griveFS) validName(name string) bool {
+    return g.encodeName(g.decodeName(name)) == name
+}
+
+// Name of the drive file in the mount, exported Google Apps files get
+// the extension of the format they are exported as.
+func (g *griveFS) nodeName(f *drive.File) string {
+    name := g.encodeName(f.Title)
+    if _, ext := g.exportFormat(f); ext != "" {
+        return name + "." + ext
+    }
+    return name
+}
+
+// Name of the drive file when an older file in the directory has the
+// same title, the short id goes before the extension.
+func (g *griveFS) dupName(f *drive.File) string {
+    name := g.nodeName(f)
+    ext := nameExt(f, name)
+    return strings.TrimSuffix(name, ext) + " (" + shortId(f.Id) + ")" + ext
+}
+
+// Title of the drive file f when it is named name in the mount.
+func (g *griveFS) nodeTitle(f *drive.File, name string) string {
+    if f.Id != "" {
+        ext := nameExt(f, name)
+        base := strings.TrimSuffix(name, ext)
+        name = strings.TrimSuffix(base, " ("+shortId(f.Id)+")") + ext
+    }
+    if _, ext := g.exportFormat(f); ext != "" {
+        name = strings.TrimSuffix(name, "."+ext)
+    }
+    return g.decodeName(name)
+}
+
+// Extension of the file name, directories and dot files have none.
+func nameExt(f *drive.File, name string) string {
+    if RemoteIsDir(f) {
+        return ""
+    }
+    ext := path.Ext(name)
+    if ext == name {
+        return ""
+    }
+    return ext
+}
+
+//
+func shortId(id string) string {
+    if len(id) > shortIdLen {
+        return id[len(id)-shortIdLen:]
+    }
+    return id
+}
+
+// Whether the file a keeps the title when b has the same one, the
+// files not uploaded yet and the older files go first.
+func precedes(a *drive.File, b *drive.File) bool {
+    if a.Id == "" || b.Id == "" {
+        return a.Id == ""
+    }
+    if a.CreatedDate != b.CreatedDate {
+        return a.CreatedDate < b.CreatedDate
+    }
+    return a.Id < b.Id
+}
+
+// The id of the drive file, so the names can be traced back to the
+// files on the drive.
+func (n *grvNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+    resp *fuse.GetxattrResponse) error {
+    n.RLock()
+    defer n.RUnlock()
+    if req.Name != xattrId || n.rf.Id == "" {
+        return fuse.ErrNoXattr
+    }
+    resp.Xattr = []byte(n.rf.Id)
+    return nil
+}
+
+//
+func (n *grvNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+    resp *fuse.ListxattrResponse) error {
+    n.RLock()
+    defer n.RUnlock()
+    if n.rf.Id != "" {
+        resp.Append(xattrId)
+    }
+    return nil
+}
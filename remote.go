@@ -10,7 +10,9 @@ import (
     log "github.com/Sirupsen/logrus"
     "golang.org/x/oauth2"
     drive "google.golang.org/api/drive/v2"
+    "google.golang.org/api/googleapi"
     "io"
+    "io/ioutil"
     "net/http"
     "strings"
     "time"
@@ -20,24 +22,71 @@ const (
     mimeFolder           string = "application/vnd.google-apps.folder"
     mimeGoogleApps       string = "application/vnd.google-apps."
     Scope                       = "https://www.googleapis.com/auth/drive"
-    RedirectURL                 = "urn:ietf:wg:oauth:2.0:oob"
+    ReadOnlyScope               = "https://www.googleapis.com/auth/drive.readonly"
+    FileScope                   = "https://www.googleapis.com/auth/drive.file"
     GoogleOAuth2AuthURL         = "https://accounts.google.com/o/oauth2/auth"
     GoogleOAuth2TokenURL        = "https://accounts.google.com/o/oauth2/token"
 )
 
+// Kinds of the errors drive refuses the requests with.
+var (
+    ErrNotFound     = errors.New("File not found")
+    ErrForbidden    = errors.New("Access to the file is forbidden")
+    ErrRateLimited  = errors.New("Drive rate limit exceeded")
+    ErrAbuseFlagged = errors.New("File was flagged as abusive")
+)
+
+// Error drive refused the request with, Kind is one of the errors
+// above or nil when the error is of no special kind.
+type RemoteError struct {
+    Kind    error
+    Code    int
+    Reason  string
+    Message string
+}
+
+//
+func (e *RemoteError) Error() string {
+    msg := e.Message
+    if e.Kind != nil {
+        msg = e.Kind.Error()
+    }
+    return fmt.Sprintf("%s (%d %s)", msg, e.Code, e.Reason)
+}
+
+// Export formats of the Google Apps files by extension.
+var exportMimeTypes = map[string]string{
+    "csv":  "text/csv",
+    "docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+    "html": "text/html",
+    "jpg":  "image/jpeg",
+    "odp":  "application/vnd.oasis.opendocument.presentation",
+    "ods":  "application/x-vnd.oasis.opendocument.spreadsheet",
+    "odt":  "application/vnd.oasis.opendocument.text",
+    "pdf":  "application/pdf",
+    "png":  "image/png",
+    "pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+    "rtf":  "application/rtf",
+    "svg":  "image/svg+xml",
+    "txt":  "text/plain",
+    "xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
 type Remote struct {
     *drive.Service
     c        *http.Client
     a        *drive.About
     requests uint64
+    retries  int
 }
 
+var _ DriveBackend = (*Remote)(nil)
+
 func makeOAuthConfig(c *Config) *oauth2.Config {
     return &oauth2.Config{
         ClientID:     c.ClientId,
         ClientSecret: c.ClientSecret,
         Scopes:       []string{Scope},
-        RedirectURL:  RedirectURL,
         Endpoint: oauth2.Endpoint{
             AuthURL:  GoogleOAuth2AuthURL,
             TokenURL: GoogleOAuth2TokenURL,
@@ -47,40 +96,59 @@ func makeOAuthConfig(c *Config) *oauth2.Config {
 
 // Create new Remote object from the configuration provided, if there
 // is no refresh token we need to user authorize the access to his
-// drive first.
+// drive first. A service account needs no authorization.
 func MakeRemote(c *Config) (*Remote, error) {
     var tok *oauth2.Token
     var err error
     logger := log.WithField("func", "remote.go:MakeRemote")
+    if c.ServiceAccount != "" {
+        logger.Info("Connecting as service account ...")
+        src, err := serviceAccountSource(c)
+        if err != nil {
+            return nil, err
+        }
+        return MakeRemoteFromClient(c, oauth2.NewClient(oauth2.NoContext, src), "")
+    }
     config := makeOAuthConfig(c)
     if c.RefreshToken == "" {
         logger.Info("Connecting to unauthorized drive ...")
-        authUrl := config.AuthCodeURL("state", oauth2.AccessTypeOffline)
-        fmt.Println("Please visit this URL to get an authorization code")
-        fmt.Println(authUrl)
-        fmt.Print("Paste the authorization code: ")
-        var code string
-        if _, err = fmt.Scan(&code); err != nil {
-            logger.Fatal(err)
-        }
-        tok, err = config.Exchange(oauth2.NoContext, code)
-        if err != nil {
-            logger.Fatal(err)
+        if tok, err = authorizeConfig(c, false); err != nil {
+            return nil, err
         }
-        c.RefreshToken = tok.RefreshToken
-        c.Write()
     } else {
         logger.Info("Connecting to existing drive ...")
         tok = &oauth2.Token{RefreshToken: c.RefreshToken}
     }
 
-    client := config.Client(oauth2.NoContext, tok)
+    return MakeRemoteFromClient(c, config.Client(oauth2.NoContext, tok), "")
+}
+
+// Create new Remote object using the authorized client, basePath
+// points it to another Drive API endpoint when not empty. The requests
+// are limited and retried as set in the configuration.
+func MakeRemoteFromClient(c *Config, client *http.Client, basePath string) (*Remote, error) {
+    if limit := makeRateLimiter(c.QPS); limit != nil {
+        base := client.Transport
+        if base == nil {
+            base = http.DefaultTransport
+        }
+        lc := *client
+        lc.Transport = &limitedTransport{base, limit}
+        client = &lc
+    }
     d, err := drive.New(client)
     if err != nil {
         return nil, err
     }
-    a, err := d.About.Get().Do()
-    return &Remote{d, client, a, 1}, err
+    if basePath != "" {
+        d.BasePath = basePath
+    }
+    r := &Remote{Service: d, c: client, requests: 1, retries: c.MaxRetries}
+    err = r.retry("remote.go:MakeRemote", func() (err error) {
+        r.a, err = d.About.Get().Do()
+        return err
+    })
+    return r, err
 }
 
 func (d *Remote) GetRootFile() (*drive.File, error) {
@@ -89,18 +157,72 @@ func (d *Remote) GetRootFile() (*drive.File, error) {
 
 // Gets all the drive.File items in the given dir
 func (d *Remote) ListDir(dir *drive.File) ([]*drive.File, error) {
-    var fs []*drive.File
     logger := log.WithFields(log.Fields{"func": "remote.go:ListDir", "dir": dir.Title})
-    pageToken := ""
     logger.Debug("Listing directory")
+    return d.list(logger, fmt.Sprintf("'%s' in parents", dir.Id), dir.DriveId)
+}
+
+// All the files other users shared with the user, they are in none of
+// the user's folders until added to one.
+func (d *Remote) ListShared() ([]*drive.File, error) {
+    logger := log.WithField("func", "remote.go:ListShared")
+    logger.Debug("Listing shared files")
+    return d.list(logger, "sharedWithMe", "")
+}
+
+// The root folders of the shared drives the user is a member of.
+func (d *Remote) ListDrives() ([]*drive.File, error) {
+    var fs []*drive.File
+    logger := log.WithField("func", "remote.go:ListDrives")
+    logger.Debug("Listing shared drives")
+    pageToken := ""
+    for {
+        q := d.Drives.List()
+        if pageToken != "" {
+            q = q.PageToken(pageToken)
+        }
+        var r *drive.DriveList
+        err := d.retry("remote.go:ListDrives", func() (err error) {
+            r, err = q.Do()
+            return err
+        })
+        if err != nil {
+            logger.Warn(err)
+            return nil, err
+        }
+        for _, dr := range r.Items {
+            fs = append(fs, driveFile(dr))
+        }
+        pageToken = r.NextPageToken
+        if pageToken == "" {
+            break
+        }
+    }
+
+    return fs, nil
+}
+
+// All the files matching the query, page by page. The files of the
+// shared drive with driveId are searched when it is not empty,
+// otherwise the files of the user.
+func (d *Remote) list(logger *log.Entry, query string, driveId string) ([]*drive.File, error) {
+    var fs []*drive.File
+    pageToken := ""
     for {
-        q := d.Files.List()
-        q.Q(fmt.Sprintf("'%s' in parents", dir.Id))
+        q := d.Files.List().SupportsAllDrives(true)
+        q.Q(query)
+        if driveId != "" {
+            q = q.Corpora("drive").DriveId(driveId).IncludeItemsFromAllDrives(true)
+        }
         // If we have a pageToken set, apply it to the query
         if pageToken != "" {
             q = q.PageToken(pageToken)
         }
-        r, err := q.Do()
+        var r *drive.FileList
+        err := d.retry("remote.go:list", func() (err error) {
+            r, err = q.Do()
+            return err
+        })
         if err != nil {
             logger.Warn(err)
             return nil, err
@@ -121,7 +243,11 @@ func (d *Remote) ListDir(dir *drive.File) ([]*drive.File, error) {
 func (d *Remote) GetFileInfo(fileId string) (*drive.File, error) {
     logger := log.WithFields(log.Fields{"func": "remote.go:GetFileInfo", "fileId": fileId})
     logger.Debug("GET file info")
-    f, err := d.Files.Get(fileId).Do()
+    var f *drive.File
+    err := d.retry("remote.go:GetFileInfo", func() (err error) {
+        f, err = d.Files.Get(fileId).SupportsAllDrives(true).Do()
+        return err
+    })
     if err != nil {
         logger.Warn(err)
         return nil, err
@@ -129,7 +255,174 @@ func (d *Remote) GetFileInfo(fileId string) (*drive.File, error) {
     return f, nil
 }
 
-func (d *Remote) Download(f *drive.File) (io.ReadCloser, error) {
+// Gets the token marking the current position in the changes feed,
+// everything changed after this point is returned by ListChanges.
+func (d *Remote) StartPageToken() (string, error) {
+    logger := log.WithField("func", "remote.go:StartPageToken")
+    var t *drive.StartPageToken
+    err := d.retry("remote.go:StartPageToken", func() (err error) {
+        t, err = d.Changes.GetStartPageToken().SupportsAllDrives(true).Do()
+        return err
+    })
+    if err != nil {
+        logger.Warn(err)
+        return "", err
+    }
+    return t.StartPageToken, nil
+}
+
+// Gets all the changes made since the page token was issued, it
+// returns them together with the token to be used for the next call.
+func (d *Remote) ListChanges(token string) ([]*drive.Change, string, error) {
+    var cs []*drive.Change
+    logger := log.WithFields(log.Fields{"func": "remote.go:ListChanges", "token": token})
+    logger.Debug("Listing changes")
+    for {
+        var r *drive.ChangeList
+        err := d.retry("remote.go:ListChanges", func() (err error) {
+            r, err = d.Changes.List().PageToken(token).IncludeDeleted(true).
+                SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Do()
+            return err
+        })
+        if err != nil {
+            logger.Warn(err)
+            return nil, "", err
+        }
+        cs = append(cs, r.Items...)
+        if r.NextPageToken == "" {
+            return cs, r.NewStartPageToken, nil
+        }
+        token = r.NextPageToken
+    }
+}
+
+// Creates a new file described by f with the content read from r, it
+// returns the file as stored on the drive. Only the uploads refused by
+// the rate limits are sent again, others might have created the file.
+func (d *Remote) Upload(f *drive.File, r io.Reader) (*drive.File, error) {
+    logger := log.WithFields(log.Fields{"func": "remote.go:Upload", "title": f.Title})
+    logger.Debug("Uploading new file")
+    var nf *drive.File
+    err := d.retryUpload("remote.go:Upload", rateLimited, r, func(r io.Reader) (err error) {
+        nf, err = d.Files.Insert(f).Media(r).SupportsAllDrives(true).Do()
+        return err
+    })
+    if err != nil {
+        err = remoteError(err)
+        logger.Warn(err)
+        return nil, err
+    }
+    return nf, nil
+}
+
+// Uploads the content read from r as a new revision of the file f,
+// the upload is refused if the file changed on the drive since f was
+// fetched.
+func (d *Remote) Update(f *drive.File, r io.Reader) (*drive.File, error) {
+    logger := log.WithFields(log.Fields{"func": "remote.go:Update", "fileId": f.Id})
+    logger.Debug("Uploading new revision")
+    var nf *drive.File
+    err := d.retryUpload("remote.go:Update", retryable, r, func(r io.Reader) (err error) {
+        c := d.Files.Update(f.Id, &drive.File{}).Media(r).SupportsAllDrives(true)
+        c.Header().Set("If-Match", f.Etag)
+        nf, err = c.Do()
+        return err
+    })
+    if err != nil {
+        err = remoteError(err)
+        logger.Warn(err)
+        return nil, err
+    }
+    return nf, nil
+}
+
+// Creates a new directory in the parent directory, it is created again
+// only when refused by the rate limits.
+func (d *Remote) Mkdir(parent *drive.File, title string) (*drive.File, error) {
+    logger := log.WithFields(log.Fields{"func": "remote.go:Mkdir", "title": title})
+    logger.Debug("Creating directory")
+    f := &drive.File{
+        Title:    title,
+        MimeType: mimeFolder,
+        Parents:  []*drive.ParentReference{{Id: parent.Id}},
+    }
+    var nf *drive.File
+    err := retryWhen(d.retries, logger, rateLimited, func() (err error) {
+        nf, err = d.Files.Insert(f).SupportsAllDrives(true).Do()
+        return err
+    })
+    if err != nil {
+        logger.Warn(err)
+        return nil, err
+    }
+    return nf, nil
+}
+
+// Changes the title of the file and moves it from the parent with id
+// from to the parent with id to. When to is empty the file is only
+// removed from the parent from.
+func (d *Remote) Move(f *drive.File, title string, from string, to string) (*drive.File, error) {
+    logger := log.WithFields(log.Fields{
+        "func":   "remote.go:Move",
+        "fileId": f.Id,
+        "title":  title})
+    logger.Debugf("Moving from %s to %s", from, to)
+    var nf *drive.File
+    err := d.retry("remote.go:Move", func() (err error) {
+        c := d.Files.Patch(f.Id, &drive.File{Title: title}).SupportsAllDrives(true)
+        if from != to {
+            c = c.RemoveParents(from)
+            if to != "" {
+                c = c.AddParents(to)
+            }
+        }
+        nf, err = c.Do()
+        return err
+    })
+    if err != nil {
+        logger.Warn(err)
+        return nil, err
+    }
+    return nf, nil
+}
+
+// Moves the file to the trash.
+func (d *Remote) Trash(f *drive.File) error {
+    logger := log.WithFields(log.Fields{"func": "remote.go:Trash", "fileId": f.Id})
+    logger.Debug("Trashing file")
+    err := d.retry("remote.go:Trash", func() error {
+        _, err := d.Files.Trash(f.Id).SupportsAllDrives(true).Do()
+        return err
+    })
+    if err != nil {
+        logger.Warn(err)
+    }
+    return err
+}
+
+// Deletes the file permanently, skipping the trash. A file not found
+// when the delete is sent again was deleted by the first attempt.
+func (d *Remote) Delete(f *drive.File) error {
+    logger := log.WithFields(log.Fields{"func": "remote.go:Delete", "fileId": f.Id})
+    logger.Debug("Deleting file")
+    attempts := 0
+    err := d.retry("remote.go:Delete", func() error {
+        attempts++
+        err := d.Files.Delete(f.Id).SupportsAllDrives(true).Do()
+        if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound && attempts > 1 {
+            return nil
+        }
+        return err
+    })
+    if err != nil {
+        logger.Warn(err)
+    }
+    return err
+}
+
+// Downloads size bytes of the file content starting at off, everything
+// from off to the end is downloaded when size is 0.
+func (d *Remote) Download(f *drive.File, off int64, size int64) (io.ReadCloser, error) {
     logger := log.WithFields(log.Fields{"func": "remote.go:Download", "fileId": f.Id})
     if f.DownloadUrl == "" {
         // If there is no downloadUrl, there is no body
@@ -138,22 +431,204 @@ func (d *Remote) Download(f *drive.File) (io.ReadCloser, error) {
         return nil, err
     }
 
-    logger.WithField("url", f.DownloadUrl).Debug("Downloading ...")
-    resp, err := d.c.Get(f.DownloadUrl)
-    if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
-        return resp.Body, err
+    logger.WithFields(log.Fields{
+        "url":  f.DownloadUrl,
+        "off":  off,
+        "size": size}).Debug("Downloading ...")
+    req, err := http.NewRequest("GET", f.DownloadUrl, nil)
+    if err != nil {
+        return nil, err
+    }
+    if size > 0 {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+size-1))
+    } else if off > 0 {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+    }
+    var resp *http.Response
+    err = d.retry("remote.go:Download", func() error {
+        return d.get(req, &resp)
+    })
+    if err != nil {
+        err = remoteError(err)
+        logger.Warn(err)
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusPartialContent && off > 0 {
+        // The range was ignored, skip to the offset.
+        if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+            resp.Body.Close()
+            return nil, err
+        }
     }
     return resp.Body, nil
 }
 
+// Downloads the Google Apps file converted to the mime type, the
+// export can't be downloaded in parts.
+func (d *Remote) Export(f *drive.File, mime string) (io.ReadCloser, error) {
+    logger := log.WithFields(log.Fields{
+        "func":   "remote.go:Export",
+        "fileId": f.Id,
+        "mime":   mime})
+    url := f.ExportLinks[mime]
+    if url == "" {
+        err := fmt.Errorf("File can't be exported as %s", mime)
+        logger.Warn(err)
+        return nil, err
+    }
+
+    logger.WithField("url", url).Debug("Exporting ...")
+    req, err := http.NewRequest("GET", url, nil)
+    if err != nil {
+        return nil, err
+    }
+    var resp *http.Response
+    err = d.retry("remote.go:Export", func() error {
+        return d.get(req, &resp)
+    })
+    if err != nil {
+        err = remoteError(err)
+        logger.Warn(err)
+        return nil, err
+    }
+    return resp.Body, nil
+}
+
+// Makes the request, the responses other than 2xx are turned into
+// the error drive sent.
+func (d *Remote) get(req *http.Request, resp **http.Response) error {
+    r, err := d.c.Do(req)
+    if err != nil {
+        return err
+    }
+    if err = googleapi.CheckResponse(r); err != nil {
+        r.Body.Close()
+        return err
+    }
+    *resp = r
+    return nil
+}
+
+// Turns the error drive sent into RemoteError, other errors are
+// returned as they are.
+func remoteError(err error) error {
+    e, ok := err.(*googleapi.Error)
+    if !ok {
+        return err
+    }
+    re := &RemoteError{Code: e.Code, Message: e.Message}
+    if len(e.Errors) > 0 {
+        re.Reason = e.Errors[0].Reason
+    }
+    switch {
+    case e.Code == http.StatusNotFound:
+        re.Kind = ErrNotFound
+    case e.Code == http.StatusTooManyRequests || isRateLimit(e):
+        re.Kind = ErrRateLimited
+    case re.Reason == "cannotDownloadAbusiveFile":
+        re.Kind = ErrAbuseFlagged
+    case e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden:
+        re.Kind = ErrForbidden
+    }
+    return re
+}
+
+// Whether the drive refused the request for good, e.g. the file is
+// gone or the user may not change it. Rate limits, expired
+// authorization and changes made meanwhile may go away.
+func isPermanent(err error) bool {
+    re, ok := remoteError(err).(*RemoteError)
+    if !ok {
+        return false
+    }
+    switch {
+    case re.Kind == ErrRateLimited,
+        re.Code == http.StatusUnauthorized,
+        re.Code == http.StatusRequestTimeout,
+        re.Code == http.StatusPreconditionFailed:
+        return false
+    }
+    return re.Code >= 400 && re.Code < 500
+}
+
+// Retries the idempotent call as long as the errors are expected to
+// go away.
+func (d *Remote) retry(fn string, call func() error) error {
+    return retry(d.retries, log.WithField("func", fn), call)
+}
+
+// Retries the upload of the content read from r while worth says so,
+// the content is read again from the start every time. A content which
+// can't be rewound is sent only once.
+func (d *Remote) retryUpload(fn string, worth func(error) bool, r io.Reader,
+    call func(io.Reader) error) error {
+    s, ok := r.(io.Seeker)
+    if !ok {
+        return call(r)
+    }
+    start, err := s.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return err
+    }
+    return retryWhen(d.retries, log.WithField("func", fn), worth, func() error {
+        if _, err := s.Seek(start, io.SeekStart); err != nil {
+            return err
+        }
+        return call(r)
+    })
+}
+
 func RemoteIsDir(f *drive.File) bool {
     return f.MimeType == mimeFolder
 }
 
+// Trashed or hidden files are not shown.
+func RemoteIsHidden(f *drive.File) bool {
+    return f.Labels != nil && (f.Labels.Trashed || f.Labels.Hidden)
+}
+
 func RemoteIsDesktopFile(f *drive.File) bool {
     return strings.HasPrefix(f.MimeType, mimeGoogleApps)
 }
 
+//
+func hasParent(f *drive.File, id string) bool {
+    for _, p := range f.Parents {
+        if p.Id == id {
+            return true
+        }
+    }
+    return false
+}
+
+// The root folder of the shared drive, it has the id of the drive and
+// the capabilities of the user in it.
+func driveFile(dr *drive.Drive) *drive.File {
+    f := &drive.File{
+        Id:           dr.Id,
+        DriveId:      dr.Id,
+        Title:        dr.Name,
+        MimeType:     mimeFolder,
+        CreatedDate:  dr.CreatedDate,
+        ModifiedDate: dr.CreatedDate,
+        Labels:       &drive.FileLabels{},
+    }
+    if c := dr.Capabilities; c != nil {
+        f.Capabilities = &drive.FileCapabilities{
+            CanAddChildren:  c.CanAddChildren,
+            CanDownload:     c.CanDownload,
+            CanEdit:         c.CanEdit,
+            CanListChildren: c.CanListChildren,
+        }
+    }
+    return f
+}
+
+//
+func isDriveRoot(f *drive.File) bool {
+    return f.DriveId != "" && f.Id == f.DriveId
+}
+
 // utility function to print the drive.File struct
 func PrintInfo(f *drive.File) {
     fields := map[string]string{
@@ -0,0 +1,257 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    drive "google.golang.org/api/drive/v2"
+    "google.golang.org/api/googleapi"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "testing"
+    "time"
+)
+
+// Remote of the fake drive with a fresh configuration, the returned
+// function closes the drive and removes the data directory.
+func makeTestRemote(t *testing.T, d *FakeDrive) (*Remote, *Config, func()) {
+    dir, err := ioutil.TempDir("", "grivefs-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := newConfig(dir+"/config.json", dir)
+    c.QPS = 0
+    r, err := d.Remote(c)
+    if err != nil {
+        d.Close()
+        os.RemoveAll(dir)
+        t.Fatal(err)
+    }
+    return r, c, func() {
+        d.Close()
+        os.RemoveAll(dir)
+    }
+}
+
+func TestListDirPages(t *testing.T) {
+    d := MakeFakeDrive()
+    r, _, done := makeTestRemote(t, d)
+    defer done()
+    d.PageSize = 2
+    for i := 0; i < 5; i++ {
+        d.AddFile(memRootId, fmt.Sprintf("file%d", i), []byte("content"))
+    }
+
+    root, err := r.GetRootFile()
+    if err != nil {
+        t.Fatal(err)
+    }
+    before := d.Requests(fakeApiPath + "files")
+    fs, err := r.ListDir(root)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(fs) != 5 {
+        t.Fatalf("Listed %d files, expected 5", len(fs))
+    }
+    seen := make(map[string]bool)
+    for _, f := range fs {
+        seen[f.Title] = true
+    }
+    if len(seen) != 5 {
+        t.Errorf("Listed the same file more times: %v", seen)
+    }
+    if n := d.Requests(fakeApiPath+"files") - before; n != 3 {
+        t.Errorf("Listed in %d requests, expected 3 pages", n)
+    }
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+    d := MakeFakeDrive()
+    r, _, done := makeTestRemote(t, d)
+    defer done()
+    f := d.AddFile(memRootId, "file", []byte("content"))
+
+    d.RateLimit(fakeApiPath+"files/", 1, 2)
+    start := time.Now()
+    got, err := r.GetFileInfo(f.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.Id != f.Id {
+        t.Errorf("Got file %s, expected %s", got.Id, f.Id)
+    }
+    if n := d.Requests(fakeApiPath + "files/"); n != 3 {
+        t.Errorf("Made %d requests, expected 3", n)
+    }
+    if waited := time.Since(start); waited < 2*time.Second {
+        t.Errorf("Retried after %v, Retry-After asks for 1s each time", waited)
+    }
+}
+
+func TestRateLimitGivesUp(t *testing.T) {
+    d := MakeFakeDrive()
+    r, _, done := makeTestRemote(t, d)
+    defer done()
+    f := d.AddFile(memRootId, "file", []byte("content"))
+
+    r.retries = 1
+    d.RateLimit(fakeApiPath+"files/", 1, 0)
+    _, err := r.GetFileInfo(f.Id)
+    e, ok := err.(*googleapi.Error)
+    if !ok || e.Code != http.StatusForbidden || !isRateLimit(e) {
+        t.Fatalf("Got %v, expected the rate limit error", err)
+    }
+    if n := d.Requests(fakeApiPath + "files/"); n != 2 {
+        t.Errorf("Made %d requests, expected 2", n)
+    }
+}
+
+func TestForbiddenNotRetried(t *testing.T) {
+    d := MakeFakeDrive()
+    r, _, done := makeTestRemote(t, d)
+    defer done()
+    f := d.AddFile(memRootId, "file", []byte("content"))
+
+    d.Fail(fakeApiPath+"files/", http.StatusForbidden, "insufficientPermissions", 1)
+    if _, err := r.GetFileInfo(f.Id); err == nil {
+        t.Fatal("Forbidden request succeeded")
+    }
+    if n := d.Requests(fakeApiPath + "files/"); n != 1 {
+        t.Errorf("Made %d requests, expected 1", n)
+    }
+}
+
+func TestWritesRetried(t *testing.T) {
+    d := MakeFakeDrive()
+    r, _, done := makeTestRemote(t, d)
+    defer done()
+    f := d.AddFile(memRootId, "file", []byte("content"))
+    dir := d.AddDir(memRootId, "dir")
+    filePath := fakeApiPath + "files/" + f.Id
+    uploadPath := "/upload" + fakeApiPath + "files"
+
+    d.Fail(filePath, http.StatusServiceUnavailable, "backendError", 1)
+    moved, err := r.Move(f, "moved", memRootId, dir.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if moved.Title != "moved" || !hasParent(moved, dir.Id) || hasParent(moved, memRootId) {
+        t.Errorf("Moved to %s in %s", moved.Title, ParentList(moved.Parents))
+    }
+
+    // The content is sent whole again.
+    d.Fail(uploadPath, http.StatusInternalServerError, "backendError", 1)
+    updated, err := r.Update(moved, bytes.NewReader([]byte("new content")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c, _ := d.Content(f.Id); string(c) != "new content" {
+        t.Errorf("Updated to %q, expected %q", c, "new content")
+    }
+    _, err = r.Update(moved, bytes.NewReader([]byte("stale")))
+    if e, ok := err.(*RemoteError); !ok || e.Code != http.StatusPreconditionFailed {
+        t.Errorf("Stale update got %v, expected the precondition to fail", err)
+    }
+
+    d.RateLimit(filePath, 0, 1)
+    if err := r.Trash(updated); err != nil {
+        t.Fatal(err)
+    }
+    if g, _ := d.GetFileInfo(f.Id); g.Labels == nil || !g.Labels.Trashed {
+        t.Error("File not trashed")
+    }
+    d.Fail(filePath, http.StatusBadGateway, "backendError", 1)
+    if err := r.Delete(updated); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := d.GetFileInfo(f.Id); err == nil {
+        t.Error("File not deleted")
+    }
+    if n := d.Requests(filePath); n != 6 {
+        t.Errorf("Made %d requests for the file, expected 6", n)
+    }
+
+    // A new file might have been created by a failed upload, only the
+    // rate limits are sent again.
+    meta := &drive.File{Title: "new", Parents: []*drive.ParentReference{{Id: memRootId}}}
+    d.Fail(uploadPath, http.StatusServiceUnavailable, "backendError", 1)
+    before := d.Requests(uploadPath)
+    if _, err := r.Upload(meta, bytes.NewReader([]byte("new"))); err == nil {
+        t.Error("Failed upload succeeded")
+    }
+    if n := d.Requests(uploadPath) - before; n != 1 {
+        t.Errorf("Uploaded %d times, expected once", n)
+    }
+    d.RateLimit(uploadPath, 0, 1)
+    nf, err := r.Upload(meta, bytes.NewReader([]byte("new")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c, _ := d.Content(nf.Id); string(c) != "new" {
+        t.Errorf("Uploaded %q, expected %q", c, "new")
+    }
+}
+
+func TestListChangesPages(t *testing.T) {
+    d := MakeFakeDrive()
+    r, _, done := makeTestRemote(t, d)
+    defer done()
+    d.PageSize = 2
+    old := d.AddFile(memRootId, "old", []byte("content"))
+
+    tok, err := r.StartPageToken()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var ids []string
+    for i := 0; i < 3; i++ {
+        ids = append(ids, d.AddFile(memRootId, fmt.Sprintf("file%d", i), nil).Id)
+    }
+    d.Trash(&drive.File{Id: ids[0]})
+    d.Delete(old)
+
+    // A failed page is asked for again, the changes before it are
+    // not lost.
+    d.Fail(fakeApiPath+"changes", http.StatusServiceUnavailable, "backendError", 1)
+    before := d.Requests(fakeApiPath + "changes")
+    cs, next, err := r.ListChanges(tok)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n := d.Requests(fakeApiPath+"changes") - before; n != 4 {
+        t.Errorf("Listed in %d requests, expected 3 pages and a retry", n)
+    }
+    want := append(ids, ids[0], old.Id)
+    if len(cs) != len(want) {
+        t.Fatalf("Got %d changes, expected %d", len(cs), len(want))
+    }
+    for i, c := range cs {
+        if c.FileId != want[i] {
+            t.Errorf("Change %d of %s, expected %s", i, c.FileId, want[i])
+        }
+    }
+    if last := cs[len(cs)-1]; !last.Deleted || last.File != nil {
+        t.Errorf("Deleted file reported as %+v", last)
+    }
+    if c := cs[3]; c.File == nil || c.File.Labels == nil || !c.File.Labels.Trashed {
+        t.Error("Trashed file not reported as trashed")
+    }
+
+    // The new start token has only the changes made after the listing.
+    if cs, _, err := r.ListChanges(next); err != nil || len(cs) != 0 {
+        t.Errorf("Listed %d changes again, %v", len(cs), err)
+    }
+    f := d.AddFile(memRootId, "new", nil)
+    cs, _, err = r.ListChanges(next)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(cs) != 1 || cs[0].FileId != f.Id {
+        t.Errorf("Got %d changes, expected only the new file", len(cs))
+    }
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "google.golang.org/api/googleapi"
+    "math/rand"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    retryBase = 500 * time.Millisecond
+    retryMax  = 32 * time.Second
+)
+
+// Client side limit of the requests per second, the requests are
+// spaced evenly so there are no bursts over the limit.
+type rateLimiter struct {
+    sync.Mutex
+    interval time.Duration
+    next     time.Time
+}
+
+// Limiter allowing qps requests per second, there is no limit when
+// qps is 0.
+func makeRateLimiter(qps float64) *rateLimiter {
+    if qps <= 0 {
+        return nil
+    }
+    return &rateLimiter{interval: time.Duration(float64(time.Second) / qps)}
+}
+
+// Blocks until the next request can be made.
+func (l *rateLimiter) wait() {
+    if l == nil {
+        return
+    }
+    l.Lock()
+    now := time.Now()
+    if l.next.Before(now) {
+        l.next = now
+    }
+    d := l.next.Sub(now)
+    l.next = l.next.Add(l.interval)
+    l.Unlock()
+    time.Sleep(d)
+}
+
+// Transport holding every request back until the limiter lets it
+// through, uploads and downloads included.
+type limitedTransport struct {
+    base  http.RoundTripper
+    limit *rateLimiter
+}
+
+//
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    t.limit.wait()
+    return t.base.RoundTrip(req)
+}
+
+// Makes the call until it succeeds, fails with an error which is not
+// worth retrying or there are no retries left. The calls are spaced
+// by an exponential backoff with jitter unless the drive asks for a
+// specific delay with Retry-After.
+func retry(retries int, logger *log.Entry, call func() error) error {
+    return retryWhen(retries, logger, retryable, call)
+}
+
+// Makes the call like retry, but only the errors for which worth
+// returns true are retried.
+func retryWhen(retries int, logger *log.Entry, worth func(error) bool, call func() error) error {
+    for n := 0; ; n++ {
+        err := call()
+        if err == nil || n >= retries || !worth(err) {
+            return err
+        }
+        wait := backoff(n, err)
+        logger.WithField("attempt", n+1).Warnf("%v, retrying in %v", err, wait)
+        time.Sleep(wait)
+    }
+}
+
+// Rate limits, server errors and network errors are expected to go
+// away, everything else is returned right away.
+func retryable(err error) bool {
+    switch e := err.(type) {
+    case *googleapi.Error:
+        if e.Code == http.StatusTooManyRequests || e.Code >= 500 {
+            return true
+        }
+        return e.Code == http.StatusForbidden && isRateLimit(e)
+    case net.Error:
+        return true
+    }
+    return false
+}
+
+// The request was refused because of the rate limits, so it was not
+// carried out and can be sent again even when it is not idempotent.
+func rateLimited(err error) bool {
+    e, ok := err.(*googleapi.Error)
+    return ok && (e.Code == http.StatusTooManyRequests ||
+        e.Code == http.StatusForbidden && isRateLimit(e))
+}
+
+// Drive reports going over the quota as 403 with one of these
+// reasons.
+func isRateLimit(e *googleapi.Error) bool {
+    for _, i := range e.Errors {
+        if i.Reason == "userRateLimitExceeded" || i.Reason == "rateLimitExceeded" {
+            return true
+        }
+    }
+    return false
+}
+
+// Delay before the retry n.
+func backoff(n int, err error) time.Duration {
+    if e, ok := err.(*googleapi.Error); ok {
+        if d := retryAfter(e.Header); d > 0 {
+            return d
+        }
+    }
+    d := retryBase << uint(n)
+    if d <= 0 || d > retryMax {
+        d = retryMax
+    }
+    return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// The Retry-After header is either in seconds or a date.
+func retryAfter(h http.Header) time.Duration {
+    v := h.Get("Retry-After")
+    if v == "" {
+        return 0
+    }
+    if s, err := strconv.Atoi(v); err == nil {
+        return time.Duration(s) * time.Second
+    }
+    if t, err := http.ParseTime(v); err == nil {
+        return t.Sub(time.Now())
+    }
+    return 0
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 Vilibald Wanča. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+import (
+    drive "google.golang.org/api/drive/v2"
+    "time"
+)
+
+const (
+    // Prefix of the ids the inodes of the virtual directories are
+    // derived from, drive ids never contain a colon.
+    virtualId = "grivefs:"
+)
+
+// Creates a directory which is not on the drive, its content is listed
+// by list instead of the parents of the files. The changes feed adds a
+// file to it when holds says so, nil holds keeps just the listed files.
+func (g *griveFS) newVirtualDir(name string, list func() ([]*drive.File, error),
+    holds func(*drive.File) bool) *grvDir {
+    now := time.Now().UTC().Format(time.RFC3339)
+    d := g.newDir(&drive.File{
+        Title:        g.decodeName(name),
+        MimeType:     mimeFolder,
+        CreatedDate:  now,
+        ModifiedDate: now,
+        Labels:       &drive.FileLabels{},
+    }, g.meta.inode(virtualId+name))
+    d.lister = list
+    d.filter = holds
+    g.virtual = append(g.virtual, d)
+    return d
+}
+
+//
+func (d *grvDir) isVirtual() bool {
+    return d.lister != nil
+}
+
+// All the files in the directory.
+func (d *grvDir) list() ([]*drive.File, error) {
+    if d.isVirtual() {
+        return d.lister()
+    }
+    return d.fs.remote.ListDir(d.rf)
+}
+
+// Whether the drive file belongs to the directory.
+func (d *grvDir) holds(f *drive.File) bool {
+    if !d.isVirtual() {
+        return hasParent(f, d.rf.Id)
+    }
+    return d.filter == nil || d.filter(f)
+}
+
+// Whether the node is a virtual directory, these can't be changed.
+func isVirtual(n interface{}) bool {
+    d, ok := n.(*grvDir)
+    return ok && d.isVirtual()
+}
+
+// Files shared with the user go to the shared directory.
+func isShared(f *drive.File) bool {
+    return f.SharedWithMeDate != ""
+}